@@ -0,0 +1,142 @@
+// blank.go
+package main
+
+/*
+	Blank page detection
+
+	Blank pages, like the verso of one sided sheets, are detected after the
+	processing steps from the share of dark pixels of the page. When the page
+	has been through OCR, the number of words found can be checked as well.
+
+		[[destination]]
+		name = "OCR (Verso)"
+		verso = true
+		blank = "remove"          # remove, mark or keep (default)
+		blankink = "0.2%"         # Maximum share of dark pixels of a blank page
+		blankwords = 3            # A page having this number of words is not blank, 0 to ignore OCR
+
+	Blank pages are removed from the document with remove. With mark, they are
+	kept, logged and listed in the BlankPages entry of the PDF information.
+	Each page follows the destination it has been scanned with: blank verso
+	pages are removed from the recto verso document even when the recto
+	destination keeps them.
+*/
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Blank page modes
+const (
+	blankKeep   = "keep"
+	blankRemove = "remove"
+	blankMark   = "mark"
+)
+
+// Pixels darker than this are ink
+const inkLevel = 128
+
+// Share of dark pixels of the page. Borders are ignored, they often have
+// shadows of the sheet edges.
+func InkCoverage(img image.Image) float64 {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	mx, my := w/20, h/20
+	n, total := 0, 0
+	for y := my; y < h-my; y++ {
+		for x := mx; x < w-mx; x++ {
+			if g.Pix[y*w+x] < inkLevel {
+				n++
+			}
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Maximum ink coverage of a blank page
+func (d *Destination) BlankInkThreshold() (float64, error) {
+	s := d.BlankInk
+	if s == "" {
+		s = "0.2%"
+	}
+	f, err := parsePercent(s)
+	if err != nil {
+		return 0, NewDocumentError("Destination.BlankInkThreshold", "invalid blankink for destination "+d.Name, err)
+	}
+	return f, nil
+}
+
+// Blank pages are detected for the destination
+func (d *Destination) DetectsBlank() bool {
+	return d.Blank == blankRemove || d.Blank == blankMark
+}
+
+// Check if the processed page is blank
+func (ij *imageJob) DetectBlank() {
+	threshold, err := ij.destination.BlankInkThreshold()
+	if err != nil {
+		ERROR.Println("imageJob.DetectBlank", err)
+		return
+	}
+	img, err := ReadJPEG(ij.current)
+	if err != nil {
+		ERROR.Println("imageJob.DetectBlank", ij.current, err)
+		return
+	}
+	ij.ink = InkCoverage(img)
+	ij.blank = ij.ink <= threshold
+	if ij.blank && ij.destination.BlankWords > 0 && ij.hocr != "" {
+		words, err := ReadHOCR(ij.hocr)
+		if err != nil {
+			ERROR.Println("imageJob.DetectBlank", ij.hocr, err)
+		} else if len(words) >= ij.destination.BlankWords {
+			TRACE.Println("Page", ij.filename, "has", len(words), "words, it's not blank")
+			ij.blank = false
+		}
+	}
+	TRACE.Println("Page", ij.filename, "ink coverage", inkPercent(ij.ink), "blank", ij.blank)
+}
+
+func inkPercent(f float64) string {
+	return fmt.Sprintf("%.2f%%", f*100)
+}
+
+// Remove blank pages from the document page list, or log them when they
+// are kept
+func (bm *OCRBatchImageManager) BlankPageFilter(pages []*imageJob) []*imageJob {
+	kept := []*imageJob{}
+	for _, ij := range pages {
+		if ij.blank {
+			d := ij.destination
+			if d == nil {
+				d = bm.destination
+			}
+			switch d.Blank {
+			case blankRemove:
+				INFO.Println("Page", ij.filename, "is blank (ink coverage "+inkPercent(ij.ink)+"), removed")
+				continue
+			case blankMark:
+				INFO.Println("Page", ij.filename, "is blank (ink coverage "+inkPercent(ij.ink)+"), kept as page", len(kept)+1)
+			}
+		}
+		kept = append(kept, ij)
+	}
+	return kept
+}
+
+// Document page numbers of blank pages, when they are marked
+func BlankPageList(pages []*imageJob) string {
+	l := []string{}
+	for i, ij := range pages {
+		if ij.blank {
+			l = append(l, fmt.Sprint(i+1))
+		}
+	}
+	return strings.Join(l, ",")
+}
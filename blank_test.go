@@ -0,0 +1,129 @@
+// blank_test.go
+package main
+
+import (
+	"github.com/simulot/hpdevices"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_InkCoverage(t *testing.T) {
+	white := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	if c := InkCoverage(white); c != 0 {
+		t.Errorf("white page coverage %v", c)
+	}
+	// Dark edges are ignored
+	for y := 0; y < 100; y++ {
+		white.Pix[y*100] = 0
+	}
+	if c := InkCoverage(white); c != 0 {
+		t.Errorf("white page with dark edge coverage %v", c)
+	}
+	if c := InkCoverage(testPage(200, 200)); c < 0.05 {
+		t.Errorf("text page coverage %v", c)
+	}
+}
+
+func Test_DetectBlank(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &Destination{Blank: blankRemove}
+	text := &imageJob{filename: filepath.Join(dir, "page-0000.jpg"), destination: d}
+	text.current = text.filename
+	if err = WriteJPEG(text.filename, testPage(200, 200), 90); err != nil {
+		t.Fatal(err)
+	}
+	blank := &imageJob{filename: filepath.Join(dir, "page-0001.jpg"), destination: d}
+	blank.current = blank.filename
+	writeTestJPEG(t, blank.filename, 200, 200)
+	text.DetectBlank()
+	blank.DetectBlank()
+	if text.blank || !blank.blank {
+		t.Errorf("text page blank %v, blank page blank %v", text.blank, blank.blank)
+	}
+
+	// Words found by OCR
+	blank.hocr = filepath.Join(dir, "page.hocr")
+	ioutil.WriteFile(blank.hocr, []byte(testHOCR), 0644)
+	d.BlankWords = 1
+	if blank.DetectBlank(); blank.blank {
+		t.Errorf("page with words is blank")
+	}
+	d.BlankWords = 5
+	if blank.DetectBlank(); !blank.blank {
+		t.Errorf("page with few words is not blank")
+	}
+
+	bm := &OCRBatchImageManager{destination: d}
+	if pages := bm.BlankPageFilter([]*imageJob{text, blank}); len(pages) != 1 || pages[0] != text {
+		t.Errorf("blank page not removed")
+	}
+	d.Blank = blankMark
+	pages := bm.BlankPageFilter([]*imageJob{text, blank})
+	if len(pages) != 2 || BlankPageList(pages) != "2" {
+		t.Errorf("blank page not marked")
+	}
+	if info := bm.DocumentInfo(pages); info["BlankPages"] != "2" {
+		t.Errorf("unexpected document information %v", info)
+	}
+}
+
+func Test_BlankVersoMerged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tolerance := 1
+	rectoDest := &Destination{Name: "Photo", VersoGap: &duration{15 * time.Minute}, VersoTolerance: &tolerance, VersoPolicy: versoSeparate}
+	versoDest := &Destination{Name: "Photo (Verso)", Verso: true, Blank: blankRemove, VersoGap: &duration{15 * time.Minute}, VersoTolerance: &tolerance, VersoPolicy: versoSeparate}
+	batch := func(name string, d *Destination, when time.Time) *OCRBatchImageManager {
+		folder := filepath.Join(dir, name)
+		os.Mkdir(folder, 0755)
+		pattern := filepath.Join(dir, "scan")
+		bm := &OCRBatchImageManager{
+			tempfolder:   folder,
+			settings:     &hpdevices.DestinationSettings{Name: d.Name, FilePattern: &pattern, Verso: d.Verso},
+			destination:  d,
+			config:       &Config{},
+			format:       ".jpg",
+			when:         when,
+			imageJobChan: make(chan *imageJob, 2),
+		}
+		for i := 0; i < 2; i++ {
+			ij := &imageJob{filename: filepath.Join(folder, JPEGPageName("page", i)+".jpg"), destination: d}
+			ij.current = ij.filename
+			writeTestJPEG(t, ij.filename, 10, 10)
+			bm.imagelist = append(bm.imagelist, ij)
+		}
+		return bm
+	}
+	recto := batch("recto", rectoDest, time.Now().Add(-time.Minute))
+	verso := batch("verso", versoDest, time.Now())
+	verso.previousbatch = recto
+	// Verso of the second sheet is blank
+	verso.imagelist[0].blank = true
+	for _, ij := range verso.imagelist {
+		verso.imageJobChan <- ij
+	}
+
+	verso.FinalizeDocumentBatch()
+	if !verso.merged {
+		t.Fatal("verso not merged")
+	}
+	for i, name := range []string{"scan-001.jpg", "scan-002.jpg", "scan-003.jpg", "scan-004.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != (i < 3) {
+			t.Errorf("%s: unexpected state %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// ccitt.go
+package main
+
+/*
+	CCITT Group 4 (T.6) encoder, for bilevel page images
+
+	Each row is coded from the changes of color it has compared to the row
+	above it, as the PDF CCITTFaxDecode filter with K = -1 expects.
+*/
+
+import (
+	"bytes"
+	"image"
+)
+
+// Bits written most significant first
+type bitWriter struct {
+	b     bytes.Buffer
+	cur   byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(code string) {
+	for _, c := range code {
+		w.cur <<= 1
+		if c == '1' {
+			w.cur |= 1
+		}
+		w.nbits++
+		if w.nbits == 8 {
+			w.b.WriteByte(w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.b.WriteByte(w.cur << (8 - w.nbits))
+		w.cur, w.nbits = 0, 0
+	}
+	return w.b.Bytes()
+}
+
+// Mode codes of T.6
+const (
+	g4Pass       = "0001"
+	g4Horizontal = "001"
+	g4EOL        = "000000000001"
+)
+
+// Vertical mode codes, by a1 - b1 from -3 to 3
+var g4Vertical = []string{"0000010", "000010", "010", "1", "011", "000011", "0000011"}
+
+func (w *bitWriter) writeRun(n int, black bool) {
+	codes := whiteRunCodes
+	if black {
+		codes = blackRunCodes
+	}
+	for n >= 2560 {
+		w.writeBits(codes[2560])
+		n -= 2560
+	}
+	if n >= 64 {
+		w.writeBits(codes[n/64*64])
+		n %= 64
+	}
+	w.writeBits(codes[n])
+}
+
+// Position of the first pixel after a0 having another color than the
+// current one, or the row width
+func nextChange(row []bool, a0 int, color bool) int {
+	i := a0 + 1
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(row) && row[i] == color; i++ {
+	}
+	if i > len(row) {
+		return len(row)
+	}
+	return i
+}
+
+// First changing element of the reference row after a0, to the given color
+func nextReferenceChange(ref []bool, a0 int, color bool) int {
+	for i := a0 + 1; i < len(ref); i++ {
+		if i < 0 {
+			continue
+		}
+		prev := false
+		if i > 0 {
+			prev = ref[i-1]
+		}
+		if ref[i] == color && prev != color {
+			return i
+		}
+	}
+	return len(ref)
+}
+
+// Encode a bilevel image, true pixels are black
+func EncodeG4(pix []bool, width, height int) []byte {
+	w := &bitWriter{}
+	ref := make([]bool, width)
+	for y := 0; y < height; y++ {
+		row := pix[y*width : (y+1)*width]
+		a0, color := -1, false
+		for a0 < width {
+			a1 := nextChange(row, a0, color)
+			b1 := nextReferenceChange(ref, a0, !color)
+			b2 := nextReferenceChange(ref, b1, color)
+			switch {
+			case b2 < a1:
+				w.writeBits(g4Pass)
+				a0 = b2
+			case a1-b1 >= -3 && a1-b1 <= 3:
+				w.writeBits(g4Vertical[a1-b1+3])
+				a0, color = a1, !color
+			default:
+				a2 := nextChange(row, a1, !color)
+				start := a0
+				if start < 0 {
+					start = 0
+				}
+				w.writeBits(g4Horizontal)
+				w.writeRun(a1-start, color)
+				w.writeRun(a2-a1, !color)
+				a0 = a2
+			}
+		}
+		ref = row
+	}
+	// End of facsimile block
+	w.writeBits(g4EOL + g4EOL)
+	return w.bytes()
+}
+
+// Black pixels of the image, darker than the threshold
+func bilevelPixels(img image.Image, threshold uint8) ([]bool, int, int) {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	pix := make([]bool, w*h)
+	for i, v := range g.Pix {
+		pix[i] = v <= threshold
+	}
+	return pix, w, h
+}
+
+// T.4 run length codes: terminating codes from 0 to 63, then makeup codes
+var whiteRunCodes = map[int]string{
+	0: "00110101", 1: "000111", 2: "0111", 3: "1000",
+	4: "1011", 5: "1100", 6: "1110", 7: "1111",
+	8: "10011", 9: "10100", 10: "00111", 11: "01000",
+	12: "001000", 13: "000011", 14: "110100", 15: "110101",
+	16: "101010", 17: "101011", 18: "0100111", 19: "0001100",
+	20: "0001000", 21: "0010111", 22: "0000011", 23: "0000100",
+	24: "0101000", 25: "0101011", 26: "0010011", 27: "0100100",
+	28: "0011000", 29: "00000010", 30: "00000011", 31: "00011010",
+	32: "00011011", 33: "00010010", 34: "00010011", 35: "00010100",
+	36: "00010101", 37: "00010110", 38: "00010111", 39: "00101000",
+	40: "00101001", 41: "00101010", 42: "00101011", 43: "00101100",
+	44: "00101101", 45: "00000100", 46: "00000101", 47: "00001010",
+	48: "00001011", 49: "01010010", 50: "01010011", 51: "01010100",
+	52: "01010101", 53: "00100100", 54: "00100101", 55: "01011000",
+	56: "01011001", 57: "01011010", 58: "01011011", 59: "01001010",
+	60: "01001011", 61: "00110010", 62: "00110011", 63: "00110100",
+	64: "11011", 128: "10010", 192: "010111", 256: "0110111",
+	320: "00110110", 384: "00110111", 448: "01100100", 512: "01100101",
+	576: "01101000", 640: "01100111", 704: "011001100", 768: "011001101",
+	832: "011010010", 896: "011010011", 960: "011010100", 1024: "011010101",
+	1088: "011010110", 1152: "011010111", 1216: "011011000", 1280: "011011001",
+	1344: "011011010", 1408: "011011011", 1472: "010011000", 1536: "010011001",
+	1600: "010011010", 1664: "011000", 1728: "010011011", 1792: "00000001000",
+	1856: "00000001100", 1920: "00000001101", 1984: "000000010010", 2048: "000000010011",
+	2112: "000000010100", 2176: "000000010101", 2240: "000000010110", 2304: "000000010111",
+	2368: "000000011100", 2432: "000000011101", 2496: "000000011110", 2560: "000000011111",
+}
+
+var blackRunCodes = map[int]string{
+	0: "0000110111", 1: "010", 2: "11", 3: "10",
+	4: "011", 5: "0011", 6: "0010", 7: "00011",
+	8: "000101", 9: "000100", 10: "0000100", 11: "0000101",
+	12: "0000111", 13: "00000100", 14: "00000111", 15: "000011000",
+	16: "0000010111", 17: "0000011000", 18: "0000001000", 19: "00001100111",
+	20: "00001101000", 21: "00001101100", 22: "00000110111", 23: "00000101000",
+	24: "00000010111", 25: "00000011000", 26: "000011001010", 27: "000011001011",
+	28: "000011001100", 29: "000011001101", 30: "000001101000", 31: "000001101001",
+	32: "000001101010", 33: "000001101011", 34: "000011010010", 35: "000011010011",
+	36: "000011010100", 37: "000011010101", 38: "000011010110", 39: "000011010111",
+	40: "000001101100", 41: "000001101101", 42: "000011011010", 43: "000011011011",
+	44: "000001010100", 45: "000001010101", 46: "000001010110", 47: "000001010111",
+	48: "000001100100", 49: "000001100101", 50: "000001010010", 51: "000001010011",
+	52: "000000100100", 53: "000000110111", 54: "000000111000", 55: "000000100111",
+	56: "000000101000", 57: "000001011000", 58: "000001011001", 59: "000000101011",
+	60: "000000101100", 61: "000001011010", 62: "000001100110", 63: "000001100111",
+	64: "0000001111", 128: "000011001000", 192: "000011001001", 256: "000001011011",
+	320: "000000110011", 384: "000000110100", 448: "000000110101", 512: "0000001101100",
+	576: "0000001101101", 640: "0000001001010", 704: "0000001001011", 768: "0000001001100",
+	832: "0000001001101", 896: "0000001110010", 960: "0000001110011", 1024: "0000001110100",
+	1088: "0000001110101", 1152: "0000001110110", 1216: "0000001110111", 1280: "0000001010010",
+	1344: "0000001010011", 1408: "0000001010100", 1472: "0000001010101", 1536: "0000001011010",
+	1600: "0000001011011", 1664: "0000001100100", 1728: "0000001100101", 1792: "00000001000",
+	1856: "00000001100", 1920: "00000001101", 1984: "000000010010", 2048: "000000010011",
+	2112: "000000010100", 2176: "000000010101", 2240: "000000010110", 2304: "000000010111",
+	2368: "000000011100", 2432: "000000011101", 2496: "000000011110", 2560: "000000011111",
+}
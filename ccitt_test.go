@@ -0,0 +1,159 @@
+// ccitt_test.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"testing"
+)
+
+// Bits read most significant first
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (byte, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, fmt.Errorf("end of data")
+	}
+	b := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return b, nil
+}
+
+// Read bits until they give one of the codes
+func (r *bitReader) code(codes map[string]int) (int, error) {
+	s := ""
+	for len(s) < 14 {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		s += string('0' + b)
+		if v, ok := codes[s]; ok {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown code %s at bit %d", s, r.pos)
+}
+
+func (r *bitReader) run(codes map[string]int) (int, error) {
+	n := 0
+	for {
+		v, err := r.code(codes)
+		if err != nil {
+			return 0, err
+		}
+		n += v
+		if v < 64 {
+			return n, nil
+		}
+	}
+}
+
+func reverseCodes(codes map[int]string) map[string]int {
+	m := make(map[string]int)
+	for v, c := range codes {
+		m[c] = v
+	}
+	return m
+}
+
+// Decode a T.6 image, true pixels are black
+func decodeG4(data []byte, width, height int) ([]bool, error) {
+	const pass, horizontal = 10, 11
+	modes := map[string]int{g4Pass: pass, g4Horizontal: horizontal}
+	for i, c := range g4Vertical {
+		modes[c] = i - 3
+	}
+	white, black := reverseCodes(whiteRunCodes), reverseCodes(blackRunCodes)
+	r := &bitReader{data: data}
+	pix := make([]bool, width*height)
+	ref := make([]bool, width)
+	for y := 0; y < height; y++ {
+		row := pix[y*width : (y+1)*width]
+		fill := func(from, to int, color bool) {
+			for i := imax(from, 0); i < to && i < width; i++ {
+				row[i] = color
+			}
+		}
+		a0, color := -1, false
+		for a0 < width {
+			mode, err := r.code(modes)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", y, err)
+			}
+			b1 := nextReferenceChange(ref, a0, !color)
+			switch mode {
+			case pass:
+				b2 := nextReferenceChange(ref, b1, color)
+				fill(a0, b2, color)
+				a0 = b2
+			case horizontal:
+				codes := [2]map[string]int{white, black}
+				if color {
+					codes[0], codes[1] = black, white
+				}
+				r1, err := r.run(codes[0])
+				if err != nil {
+					return nil, err
+				}
+				r2, err := r.run(codes[1])
+				if err != nil {
+					return nil, err
+				}
+				start := imax(a0, 0)
+				fill(start, start+r1, color)
+				fill(start+r1, start+r1+r2, !color)
+				a0 = start + r1 + r2
+			default:
+				a1 := b1 + mode
+				fill(a0, a1, color)
+				a0, color = a1, !color
+			}
+		}
+		ref = row
+	}
+	return pix, nil
+}
+
+func Test_EncodeG4Vectors(t *testing.T) {
+	for _, c := range []struct {
+		row      string
+		expected []byte
+	}{
+		// Vertical mode 0, then end of block
+		{"........", []byte{0x80, 0x08, 0x00, 0x80}},
+		// Horizontal mode, 2 white 3 black, vertical mode 0
+		{"..###...", []byte{0x2f, 0x40, 0x04, 0x00, 0x40}},
+	} {
+		pix := make([]bool, len(c.row))
+		for i := range c.row {
+			pix[i] = c.row[i] == '#'
+		}
+		if data := EncodeG4(pix, len(pix), 1); !bytes.Equal(data, c.expected) {
+			t.Errorf("%s: expecting % x, got % x", c.row, c.expected, data)
+		}
+	}
+}
+
+func Test_EncodeG4(t *testing.T) {
+	for _, page := range []*image.Gray{testPage(200, 120), testTextPage(300, 200), image.NewGray(image.Rect(0, 0, 3000, 4))} {
+		pix, w, h := bilevelPixels(page, 128)
+		data := EncodeG4(pix, w, h)
+		decoded, err := decodeG4(data, w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, black := range pix {
+			if decoded[i] != black {
+				t.Fatalf("%dx%d: pixel %d,%d differs", w, h, i%w, i/w)
+			}
+		}
+		if len(data) > w*h/8 {
+			t.Errorf("%dx%d: %d bytes", w, h, len(data))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// colormode.go
+package main
+
+/*
+	Automatic color mode
+
+	With colorspace = "Auto", pages are scanned in color, then each page is
+	stored in the smallest mode suitable for its content:
+
+		color   the page has colored areas, a letterhead for instance
+		gray    the page has no color but intermediate tones, like a photo
+		bw      text only pages, written in black and white with CCITT G4
+
+	The colormode step is added before make-pdf when omitted. Its color option
+	gives the share of colored pixels making a page colored:
+
+		[[destination.step]]
+		name = "colormode"
+		options = { color = "0.1%" }
+*/
+
+import (
+	"image"
+)
+
+// Color modes of pages
+const (
+	colorModeColor = "color"
+	colorModeGray  = "gray"
+	colorModeBW    = "bw"
+)
+
+// Color space asking for the color mode of each page
+const colorSpaceAuto = "Auto"
+
+// Color mode suitable for the page
+func ColorMode(img image.Image, colorShareMin float64) string {
+	switch {
+	case colorShare(img) > colorShareMin:
+		return colorModeColor
+	case IsTextOnly(img):
+		return colorModeBW
+	default:
+		return colorModeGray
+	}
+}
+
+// Share of colored pixels making a page colored
+func colorModeOptions(s Step) (float64, error) {
+	min, err := parsePercent(s.Option("color", "0.1%"))
+	if err != nil {
+		return 0, NewDocumentError("imageJob.ColorModeImage", "color", err)
+	}
+	return min, nil
+}
+
+func (ij *imageJob) ColorModeImage(s Step) error {
+	min, err := colorModeOptions(s)
+	if err != nil {
+		return err
+	}
+	img, err := ReadJPEG(ij.current)
+	if err != nil {
+		return err
+	}
+	ij.colorMode = ColorMode(img, min)
+	TRACE.Println("Page", ij.filename, "color mode", ij.colorMode)
+	switch ij.colorMode {
+	case colorModeGray:
+		return ij.process("imageJob.ColorModeImage", workQuality, func(img image.Image) image.Image {
+			return luminance(img)
+		})
+	case colorModeBW:
+		return ij.process("imageJob.ColorModeImage", workQuality, func(img image.Image) image.Image {
+			g := luminance(img)
+			t := otsuThreshold(g)
+			for i, v := range g.Pix {
+				if v <= t {
+					g.Pix[i] = 0
+				} else {
+					g.Pix[i] = 0xff
+				}
+			}
+			return g
+		})
+	}
+	return nil
+}
+
+// Encoding of the page image in the PDF page, black and white pages are
+// bilevel
+func (ij *imageJob) Encoding(e imageEncoding) imageEncoding {
+	if ij.colorMode == colorModeBW && e.bilevel == "" {
+		e.bilevel = bilevelG4
+	}
+	return e
+}
@@ -0,0 +1,77 @@
+// colormode_test.go
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Text page with a red letterhead
+func testLetterhead(w, h int) *image.RGBA {
+	c := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(c, c.Rect, testTextPage(w, h), image.ZP, draw.Src)
+	draw.Draw(c, image.Rect(w/10, 0, w/3, h/20), &image.Uniform{color.RGBA{0xc0, 0x10, 0x10, 0xff}}, image.ZP, draw.Src)
+	return c
+}
+
+// Page in color without any colored pixel
+func testRGB(img image.Image) *image.RGBA {
+	c := image.NewRGBA(img.Bounds())
+	draw.Draw(c, c.Rect, img, image.ZP, draw.Src)
+	return c
+}
+
+func Test_ColorMode(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		img  image.Image
+		mode string
+	}{
+		{"letterhead", testLetterhead(300, 400), colorModeColor},
+		{"photo", testRGB(testGradient(300, 400)), colorModeGray},
+		{"text", testRGB(testTextPage(300, 400)), colorModeBW},
+	} {
+		if mode := ColorMode(c.img, 0.001); mode != c.mode {
+			t.Errorf("%s: expecting %s, got %s", c.name, c.mode, mode)
+		}
+	}
+}
+
+func Test_ColorModeImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pages := []image.Image{testLetterhead(300, 400), testRGB(testTextPage(300, 400))}
+	modes := []string{colorModeColor, colorModeBW}
+	for i, page := range pages {
+		ij := &imageJob{filename: filepath.Join(dir, JPEGPageName("page", i)+".jpg")}
+		ij.current = ij.filename
+		if err = WriteJPEG(ij.filename, page, 95); err != nil {
+			t.Fatal(err)
+		}
+		if err = ij.ColorModeImage(Step{Name: "colormode"}); err != nil {
+			t.Fatal(err)
+		}
+		if ij.colorMode != modes[i] {
+			t.Errorf("page %d: expecting %s, got %s", i, modes[i], ij.colorMode)
+		}
+		img, err := ReadJPEG(ij.current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, gray := img.(*image.Gray)
+		if gray != (modes[i] != colorModeColor) {
+			t.Errorf("page %d: unexpected image %T", i, img)
+		}
+		if e := ij.Encoding(imageEncoding{}); (e.bilevel == bilevelG4) != (modes[i] == colorModeBW) {
+			t.Errorf("page %d: unexpected encoding %v", i, e)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// compress.go
+package main
+
+/*
+	Compression of PDF documents
+
+	Page images are embedded as received by default. The destination can ask
+	for smaller documents:
+
+		[[destination]]
+		name = "Archive"
+		filepattern = "~/Archive/%Y/%Y%m%d-%H%M%S"
+
+		[destination.compression]
+		quality = 60          # JPEG quality of page images
+		dpi = 150             # Page images are downsampled to this resolution
+		bilevel = "g4"        # Text only pages in black and white: g4 or jbig2
+		maxsize = "2MB"       # Size the document should not exceed
+
+	Downsampling keeps the page size, and the text layer positions. Text only
+	pages are recognised from the contrast of their pixels, they are written
+	at the scan resolution with CCITT Group 4 or JBIG2 (jbig2enc is needed).
+
+	When the document exceeds maxsize, its pages are encoded again with a
+	lower quality, then a lower resolution, until it fits or no reduction is
+	left. Pages made by hocr2pdf can't be encoded again.
+
+	Compression settings apply to PDF documents, the compress step gives the
+	quality of JPEG documents.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Compression struct {
+	Quality int    `toml:"quality"`
+	DPI     int    `toml:"dpi"`
+	Bilevel string `toml:"bilevel"`
+	MaxSize string `toml:"maxsize"`
+}
+
+// Bilevel encodings
+const (
+	bilevelG4    = "g4"
+	bilevelJBIG2 = "jbig2"
+)
+
+// Encoding of a page image. The zero value keeps the received JPEG.
+type imageEncoding struct {
+	quality int    // JPEG quality, 0 keeps the received JPEG
+	dpi     int    // Resolution of the image, 0 keeps the scan resolution
+	bilevel string // Encoding of text only pages, empty to keep them in JPEG
+}
+
+func (c *Compression) Check(d *Destination) error {
+	if c.Quality < 0 || c.Quality > 100 {
+		return NewDocumentError("Compression.Check", fmt.Sprint("invalid quality ", c.Quality, " for destination ", d.Name))
+	}
+	if c.DPI < 0 {
+		return NewDocumentError("Compression.Check", fmt.Sprint("invalid dpi ", c.DPI, " for destination ", d.Name))
+	}
+	if !contains([]string{"", bilevelG4, bilevelJBIG2}, c.Bilevel) {
+		return NewDocumentError("Compression.Check", "unknown bilevel encoding "+c.Bilevel+" for destination "+d.Name)
+	}
+	if _, err := c.maxSize(); err != nil {
+		return NewDocumentError("Compression.Check", "destination "+d.Name, err)
+	}
+	return nil
+}
+
+// Maximum document size in bytes, 0 when not limited
+func (c *Compression) maxSize() (int64, error) {
+	if c.MaxSize == "" {
+		return 0, nil
+	}
+	return parseSize(c.MaxSize)
+}
+
+// Parse a size like 800kB or 2MB, units are multiples of 1024
+func parseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	unit := int64(1)
+	for i, u := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(v, u) {
+			v, unit = strings.TrimSpace(strings.TrimSuffix(v, u)), 1<<(10*uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// Encoding of page images given by the destination
+func (c *Compression) Encoding() imageEncoding {
+	return imageEncoding{quality: c.Quality, dpi: c.DPI, bilevel: c.Bilevel}
+}
+
+// Encodings to try, from the one given by the destination to the smallest
+func (c *Compression) Levels(scanDPI int) []imageEncoding {
+	first := c.Encoding()
+	levels := []imageEncoding{first}
+	quality := first.quality
+	if quality == 0 {
+		quality = 90
+	}
+	for _, q := range []int{75, 60, 45, 30} {
+		if q < quality {
+			e := first
+			e.quality = q
+			levels = append(levels, e)
+		}
+	}
+	dpi := first.dpi
+	if dpi == 0 || dpi > scanDPI {
+		dpi = scanDPI
+	}
+	for _, r := range []int{200, 150, 100} {
+		if r < dpi {
+			e := levels[len(levels)-1]
+			e.dpi = r
+			levels = append(levels, e)
+		}
+	}
+	return levels
+}
+
+// A text only page has dark and light pixels, with few intermediate tones
+// and no color. The share of variance explained by the split of pixels in
+// dark and light ones is high.
+func IsTextOnly(img image.Image) bool {
+	if colorShare(img) > 0.001 {
+		return false
+	}
+	g := luminance(img)
+	t := int(otsuThreshold(g))
+	var n, sum, sumSq [2]float64
+	for _, v := range g.Pix {
+		k := 0
+		if int(v) > t {
+			k = 1
+		}
+		f := float64(v)
+		n[k]++
+		sum[k] += f
+		sumSq[k] += f * f
+	}
+	if n[0] == 0 || n[1] == 0 {
+		// Blank page
+		return true
+	}
+	total := n[0] + n[1]
+	mean := (sum[0] + sum[1]) / total
+	variance := (sumSq[0]+sumSq[1])/total - mean*mean
+	m0, m1 := sum[0]/n[0], sum[1]/n[1]
+	between := n[0] * n[1] / (total * total) * (m0 - m1) * (m0 - m1)
+	return variance > 0 && between/variance >= 0.85
+}
+
+// Share of colored pixels. A pixel is colored when its channels differ by
+// more than 32.
+func colorShare(img image.Image) float64 {
+	pix, stride, w, h, ch := rawPixels(img)
+	if ch == 1 {
+		return 0
+	}
+	n := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*stride + x*4
+			r, g, b := int(pix[i]), int(pix[i+1]), int(pix[i+2])
+			hi, lo := imax(r, imax(g, b)), imin(r, imin(g, b))
+			if hi-lo > 32 {
+				n++
+			}
+		}
+	}
+	return float64(n) / float64(w*h)
+}
+
+// Downsample the image to the given size, each pixel is the mean of the
+// pixels it covers
+func Resize(img image.Image, nw, nh int) image.Image {
+	pix, stride, w, h, ch := rawPixels(img)
+	if nw >= w || nh >= h {
+		return img
+	}
+	out := make([]uint8, nw*nh*ch)
+	for y := 0; y < nh; y++ {
+		y0, y1 := y*h/nh, (y+1)*h/nh
+		for x := 0; x < nw; x++ {
+			x0, x1 := x*w/nw, (x+1)*w/nw
+			for c := 0; c < ch; c++ {
+				s := 0
+				for sy := y0; sy < y1; sy++ {
+					for sx := x0; sx < x1; sx++ {
+						s += int(pix[sy*stride+sx*ch+c])
+					}
+				}
+				out[(y*nw+x)*ch+c] = uint8(s / ((y1 - y0) * (x1 - x0)))
+			}
+		}
+	}
+	return newPixels(out, nw, nh, ch)
+}
+
+// Image XObject of the page, encoded as requested
+func pageImage(data []byte, dpi int, e imageEncoding) (*pdfStream, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if e == (imageEncoding{}) {
+		return jpegImage(data, cfg.Width, cfg.Height, cfg.ColorModel), nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if e.bilevel != "" && IsTextOnly(img) {
+		return bilevelImage(img, e.bilevel)
+	}
+	if e.dpi > 0 && e.dpi < dpi {
+		img = Resize(img, cfg.Width*e.dpi/dpi, cfg.Height*e.dpi/dpi)
+	} else if e.quality == 0 {
+		return jpegImage(data, cfg.Width, cfg.Height, cfg.ColorModel), nil
+	}
+	quality := e.quality
+	if quality == 0 {
+		quality = 90
+	}
+	p := pixels(img)
+	var b bytes.Buffer
+	if err = jpeg.Encode(&b, p, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	if b.Len() >= len(data) && p.Bounds().Dx() == cfg.Width {
+		// Nothing gained
+		return jpegImage(data, cfg.Width, cfg.Height, cfg.ColorModel), nil
+	}
+	m := color.Model(color.RGBAModel)
+	if _, ok := p.(*image.Gray); ok {
+		m = color.GrayModel
+	}
+	return jpegImage(b.Bytes(), p.Bounds().Dx(), p.Bounds().Dy(), m), nil
+}
+
+func jpegImage(data []byte, width, height int, m color.Model) *pdfStream {
+	img := pdfDict{
+		"Type":             pdfName("XObject"),
+		"Subtype":          pdfName("Image"),
+		"Width":            width,
+		"Height":           height,
+		"BitsPerComponent": 8,
+		"Filter":           pdfName("DCTDecode"),
+	}
+	switch m {
+	case color.GrayModel:
+		img["ColorSpace"] = pdfName("DeviceGray")
+	case color.CMYKModel:
+		img["ColorSpace"] = pdfName("DeviceCMYK")
+		img["Decode"] = pdfArray{1, 0, 1, 0, 1, 0, 1, 0}
+	default:
+		img["ColorSpace"] = pdfName("DeviceRGB")
+	}
+	return &pdfStream{Dict: img, Data: data}
+}
+
+// Black and white image, at the scan resolution
+func bilevelImage(img image.Image, encoding string) (*pdfStream, error) {
+	pix, w, h := bilevelPixels(img, otsuThreshold(luminance(img)))
+	dict := pdfDict{
+		"Type":             pdfName("XObject"),
+		"Subtype":          pdfName("Image"),
+		"Width":            w,
+		"Height":           h,
+		"BitsPerComponent": 1,
+		"ColorSpace":       pdfName("DeviceGray"),
+	}
+	if encoding == bilevelJBIG2 {
+		data, err := encodeJBIG2(pix, w, h)
+		if err != nil {
+			return nil, err
+		}
+		dict["Filter"] = pdfName("JBIG2Decode")
+		return &pdfStream{Dict: dict, Data: data}, nil
+	}
+	dict["Filter"] = pdfName("CCITTFaxDecode")
+	dict["DecodeParms"] = pdfDict{"K": -1, "Columns": w, "Rows": h, "BlackIs1": false}
+	return &pdfStream{Dict: dict, Data: EncodeG4(pix, w, h)}, nil
+}
+
+// Encode with jbig2enc, in generic region mode, ready for PDF
+func encodeJBIG2(pix []bool, w, h int) ([]byte, error) {
+	g := image.NewGray(image.Rect(0, 0, w, h))
+	for i, black := range pix {
+		if !black {
+			g.Pix[i] = 0xff
+		}
+	}
+	f, err := ioutil.TempFile("", "scantopc-jbig2")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	err = png.Encode(f, g)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("jbig2", "-p", f.Name())
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err = cmd.Start(); err != nil {
+		return nil, NewDocumentError("encodeJBIG2", "jbig2", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		err = <-done
+	}
+	if err != nil {
+		return nil, NewDocumentError("encodeJBIG2", "jbig2", err)
+	}
+	return out.Bytes(), nil
+}
+
+// Encode pages again, lower and lower, until the document fits in the
+// maximum size of the destination. join writes the document from pages.
+func (bm *OCRBatchImageManager) FitDocument(filename string, pages []*imageJob, join func() error) error {
+	c := &bm.destination.Compression
+	max, _ := c.maxSize()
+	info, err := os.Stat(filename)
+	if err != nil || max == 0 || info.Size() <= max {
+		return err
+	}
+	for _, s := range bm.destination.Steps {
+		if s.Name == "make-pdf" && s.Option("tool", "native") == "hocr2pdf" {
+			WARNING.Println("Document", bm.filename, "exceeds", c.MaxSize, "but pages made by hocr2pdf can't be encoded again")
+			return nil
+		}
+	}
+	levels := c.Levels(bm.destination.Resolution)
+	for i, e := range levels[1:] {
+		TRACE.Println("Document", bm.filename, "has", info.Size(), "bytes, trying level", i+1, "quality", e.quality, "dpi", e.dpi)
+		for _, ij := range pages {
+			// Pages are kept at full quality for a later recto verso document
+			ij.fitted = ij.WorkName() + "-fit.pdf"
+			if err = WriteEncodedPDF(ij.current, ij.hocr, ij.destination.Resolution, ij.fitted, ij.Encoding(e)); err != nil {
+				return err
+			}
+		}
+		if err = join(); err != nil {
+			return err
+		}
+		if info, err = os.Stat(filename); err != nil {
+			return err
+		}
+		if info.Size() <= max {
+			INFO.Println("Document", bm.filename, "reduced to", info.Size(), "bytes, quality", e.quality, "dpi", e.dpi)
+			return nil
+		}
+	}
+	WARNING.Println("Document", bm.filename, "has", info.Size(), "bytes, it can't be reduced to", c.MaxSize)
+	return nil
+}
@@ -0,0 +1,179 @@
+// compress_test.go
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseSize(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"2MB", 2 << 20, true}, {"800kB", 800 << 10, true}, {"1.5 G", 3 << 29, true},
+		{"123456", 123456, true}, {"0", 0, false}, {"big", 0, false},
+	} {
+		size, err := parseSize(c.s)
+		if (err == nil) != c.ok || size != c.size {
+			t.Errorf("parseSize(%q) = %v, %v", c.s, size, err)
+		}
+	}
+}
+
+func Test_CompressionLevels(t *testing.T) {
+	c := &Compression{Quality: 60, Bilevel: bilevelG4}
+	levels := c.Levels(300)
+	expected := []imageEncoding{
+		{60, 0, "g4"}, {45, 0, "g4"}, {30, 0, "g4"}, {30, 200, "g4"}, {30, 150, "g4"}, {30, 100, "g4"},
+	}
+	if len(levels) != len(expected) {
+		t.Fatalf("unexpected levels %v", levels)
+	}
+	for i := range expected {
+		if levels[i] != expected[i] {
+			t.Errorf("level %d: expecting %v, got %v", i, expected[i], levels[i])
+		}
+	}
+}
+
+// Gray image having all tones, like a photo
+func testGradient(w, h int) *image.Gray {
+	g := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			g.Pix[y*w+x] = uint8((x + y) * 255 / (w + h))
+		}
+	}
+	return g
+}
+
+func Test_IsTextOnly(t *testing.T) {
+	if !IsTextOnly(testTextPage(300, 300)) {
+		t.Errorf("text page not detected")
+	}
+	if IsTextOnly(testGradient(300, 300)) {
+		t.Errorf("gradient detected as text")
+	}
+	c := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for i := 0; i < len(c.Pix); i += 4 {
+		c.Pix[i], c.Pix[i+1], c.Pix[i+2], c.Pix[i+3] = 0xff, 0xff, 0xff, 0xff
+	}
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			c.Set(x, y, color.RGBA{0xff, 0, 0, 0xff})
+		}
+	}
+	if IsTextOnly(c) {
+		t.Errorf("colored page detected as text")
+	}
+}
+
+func Test_WriteEncodedPDF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	photo := filepath.Join(dir, "photo.jpg")
+	text := filepath.Join(dir, "text.jpg")
+	hocr := filepath.Join(dir, "page.hocr")
+	ioutil.WriteFile(hocr, []byte(testHOCR), 0644)
+	if err = WriteJPEG(photo, testGradient(850, 1100), 95); err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteJPEG(text, testTextPage(850, 1100), 95); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(filename string) (box pdfArray, img *pdfStream, content string) {
+		r, err := ReadPDFFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages, _ := r.Pages()
+		page := r.Page(pages[0])
+		img, _ = r.Resolve(r.dict(r.dict(page["Resources"])["XObject"])["Im0"]).(*pdfStream)
+		data, err := r.decode(r.Resolve(page["Contents"]).(*pdfStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.array(page["MediaBox"]), img, string(data)
+	}
+
+	reference := filepath.Join(dir, "reference.pdf")
+	if err = WriteSearchablePDF(photo, hocr, 100, reference); err != nil {
+		t.Fatal(err)
+	}
+	refBox, refImg, refContent := read(reference)
+
+	// Downsampled image, the page and the text layer are unchanged
+	small := filepath.Join(dir, "small.pdf")
+	if err = WriteEncodedPDF(photo, hocr, 100, small, imageEncoding{quality: 50, dpi: 50, bilevel: bilevelG4}); err != nil {
+		t.Fatal(err)
+	}
+	box, img, content := read(small)
+	if box[2] != refBox[2] || box[3] != refBox[3] || content != refContent {
+		t.Errorf("page changed by downsampling: %v %s", box, content)
+	}
+	if img.Dict["Width"] != 425 || img.Dict["Height"] != 550 || img.Dict["Filter"] != pdfName("DCTDecode") || len(img.Data) >= len(refImg.Data) {
+		t.Errorf("unexpected image %v, %d bytes", img.Dict, len(img.Data))
+	}
+
+	// Text page in black and white
+	bilevel := filepath.Join(dir, "bilevel.pdf")
+	if err = WriteEncodedPDF(text, hocr, 100, bilevel, imageEncoding{dpi: 50, bilevel: bilevelG4}); err != nil {
+		t.Fatal(err)
+	}
+	box, img, content = read(bilevel)
+	if box[2] != refBox[2] || content != refContent {
+		t.Errorf("page changed by bilevel encoding: %v %s", box, content)
+	}
+	if img.Dict["Filter"] != pdfName("CCITTFaxDecode") || img.Dict["Width"] != 850 || img.Dict["BitsPerComponent"] != 1 {
+		t.Errorf("unexpected image %v", img.Dict)
+	}
+}
+
+func Test_FitDocument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &Destination{Resolution: 100, Compression: Compression{MaxSize: "60kB"}}
+	bm := &OCRBatchImageManager{destination: d, config: &Config{}, filename: filepath.Join(dir, "doc.pdf")}
+	pages := []*imageJob{}
+	for i := 0; i < 2; i++ {
+		ij := &imageJob{filename: filepath.Join(dir, JPEGPageName("page", i)+".jpg"), destination: d}
+		ij.current = ij.filename
+		if err = WriteJPEG(ij.filename, testGradient(850, 1100), 100); err != nil {
+			t.Fatal(err)
+		}
+		if err = WriteSearchablePDF(ij.current, "", 100, ij.PDFName()); err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, ij)
+	}
+	join := func() error { return CreatePDFNative(bm.filename, pages, nil) }
+	if err = join(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(bm.filename)
+	page, _ := os.Stat(pages[0].PDFName())
+	if err = bm.FitDocument(bm.filename, pages, join); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(bm.filename)
+	if before.Size() <= 60<<10 || after.Size() > 60<<10 {
+		t.Errorf("document size %d before, %d after", before.Size(), after.Size())
+	}
+	// Pages at full quality are kept for a recto verso document
+	if p, _ := os.Stat(pages[0].PDFName()); p.Size() != page.Size() || pages[0].DocumentPDF() == pages[0].PDFName() {
+		t.Errorf("page %s replaced by the reduced one", pages[0].PDFName())
+	}
+}
@@ -0,0 +1,438 @@
+// config.go
+package main
+
+/*
+	Configuration file handling
+
+	The configuration file is written in TOML. Each [[destination]] table
+	describes an entry shown on the printer panel:
+
+		name = "scanner"                  # Name of the computer on the printer
+		printer = "http://1.2.3.4:8080"   # Printer URL, discovered when omitted
+		pdftool = "pdfunite"
+
+		[[destination]]
+		name = "OCR"
+		filepattern = "~/Documents/%Y/%Y.%m/%Y.%m.%d-%H.%M.%S"
+		ocr = true
+		verso = false
+		resolution = 300
+		colorspace = "Gray"                # Gray, Color or Auto (see colormode.go)
+		languages = ["eng", "deu"]        # tesseract languages, default fra
+		psm = 3                           # tesseract page segmentation mode
+		oem = 1                           # tesseract OCR engine mode
+		zip = true                        # Jpeg documents: pages bundled in a ZIP file
+
+	Command line flags take precedence over values read from the file.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/simulot/hpdevices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Destination struct {
+	Name        string   `toml:"name"`
+	FilePattern string   `toml:"filepattern"`
+	DoOCR       bool     `toml:"ocr"`
+	Verso       bool     `toml:"verso"`
+	Resolution  int      `toml:"resolution"`
+	ColorSpace  string   `toml:"colorspace"`
+	Languages   []string `toml:"languages"`
+	PSM         *int     `toml:"psm"`
+	OEM         *int     `toml:"oem"`
+	Steps       []Step   `toml:"step"`
+	Zip         bool     `toml:"zip"`
+	Collision   string   `toml:"collision"`
+	Owner       string   `toml:"owner"`
+	Mode        string   `toml:"mode"`
+	DirMode     string   `toml:"dirmode"`
+
+	VersoGap       *duration `toml:"versogap"`
+	VersoTolerance *int      `toml:"versotolerance"`
+	VersoPolicy    string    `toml:"versopolicy"`
+
+	Blank      string `toml:"blank"`
+	BlankInk   string `toml:"blankink"`
+	BlankWords int    `toml:"blankwords"`
+
+	Separator string `toml:"separator"`
+
+	Compression Compression `toml:"compression"`
+}
+
+type Config struct {
+	ComputerName string           `toml:"name"`
+	PrinterURL   string           `toml:"printer"`
+	PDFTool      string           `toml:"pdftool"`
+	OCR          *bool            `toml:"ocr"`
+	Trace        bool             `toml:"trace"`
+	Destinations []Destination    `toml:"destination"`
+	Devices      []Device         `toml:"device"`
+	RetryMin     duration         `toml:"retrymin"`
+	RetryMax     duration         `toml:"retrymax"`
+	Discovery    *DiscoveryConfig `toml:"discovery"`
+	Drain        duration         `toml:"drain"`
+	Abandoned    string           `toml:"abandoned"`
+	Quarantine   string           `toml:"quarantine"`
+	Spool        string           `toml:"spool"`
+	SpoolMaxAge  duration         `toml:"spoolmaxage"`
+	Workers      int              `toml:"workers"`
+}
+
+// Duration given as a string like "1m30s"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Destinations used when no configuration file is given
+func DefaultDestinations(pattern string) []Destination {
+	l := []Destination{
+		Destination{
+			Name:        "OCR",
+			FilePattern: pattern,
+			DoOCR:       true,
+			Verso:       false,
+			Resolution:  300,
+			ColorSpace:  "Gray",
+		},
+		Destination{
+			Name:        "OCR (Verso)",
+			FilePattern: pattern,
+			DoOCR:       true,
+			Verso:       true,
+			Resolution:  300,
+			ColorSpace:  "Gray",
+		},
+	}
+	for i := range l {
+		l[i].SetDefaults()
+	}
+	return l
+}
+
+// Give default values to settings not given by the configuration
+func (d *Destination) SetDefaults() {
+	if d.Resolution == 0 {
+		d.Resolution = 300
+	}
+	if d.ColorSpace == "" {
+		d.ColorSpace = "Gray"
+	}
+	if len(d.Languages) == 0 {
+		d.Languages = []string{"fra"}
+	}
+	if d.Collision == "" {
+		d.Collision = collisionCounter
+	}
+	if d.VersoGap == nil {
+		d.VersoGap = &duration{15 * time.Minute}
+	}
+	if d.VersoTolerance == nil {
+		tolerance := 1
+		d.VersoTolerance = &tolerance
+	}
+	if d.VersoPolicy == "" {
+		d.VersoPolicy = versoSeparate
+	}
+	if len(d.Steps) == 0 {
+		d.Steps = DefaultPipeline(d.DoOCR)
+	} else if !d.HasStep("make-pdf") {
+		d.Steps = append(d.Steps, Step{Name: "make-pdf"})
+	}
+	if d.ColorSpace == colorSpaceAuto && !d.HasStep("colormode") {
+		d.Steps = append(d.Steps[:len(d.Steps)-1:len(d.Steps)-1], Step{Name: "colormode"}, d.Steps[len(d.Steps)-1])
+	}
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	c := new(Config)
+	if filename == "" {
+		return c, nil
+	}
+	md, err := toml.DecodeFile(filename, c)
+	if err != nil {
+		return nil, NewDocumentError("LoadConfig", filename, err)
+	}
+	if u := md.Undecoded(); len(u) > 0 {
+		return nil, NewDocumentError("LoadConfig", fmt.Sprint(filename, ": unknown keys ", u))
+	}
+	return c, nil
+}
+
+// Give precedence to flags explicitly set on the command line, values not
+// given in the configuration file are taken from flags defaults.
+func (c *Config) MergeFlags(set map[string]bool) {
+	if set["name"] || c.ComputerName == "" {
+		c.ComputerName = paramComputerName
+	}
+	if set["printer"] || c.PrinterURL == "" {
+		c.PrinterURL = paramPrinterURL
+	}
+	if set["pdftool"] || c.PDFTool == "" {
+		c.PDFTool = paramPFDTool
+	}
+	if set["ocr"] || c.OCR == nil {
+		ocr := paramOCR
+		c.OCR = &ocr
+	}
+	if set["trace"] {
+		c.Trace = paramModeTrace
+	}
+	if len(c.Destinations) == 0 {
+		pattern := paramFolderPatern
+		if pattern == "" {
+			pattern = "./%Y%m%d-%H%M%S"
+			WARNING.Println("No destination given, assuming: -destination=" + pattern)
+		}
+		c.Destinations = DefaultDestinations(pattern)
+	}
+	if c.RetryMin.Duration == 0 {
+		c.RetryMin.Duration = 5 * time.Second
+	}
+	if c.RetryMax.Duration == 0 {
+		c.RetryMax.Duration = 10 * time.Minute
+	}
+	if c.Drain.Duration == 0 {
+		c.Drain.Duration = 2 * time.Minute
+	}
+	if c.SpoolMaxAge.Duration == 0 {
+		c.SpoolMaxAge.Duration = 7 * 24 * time.Hour
+	}
+	if c.Discovery != nil {
+		if c.Discovery.Timeout.Duration == 0 {
+			c.Discovery.Timeout.Duration = 3 * time.Second
+		}
+		if c.Discovery.Interval.Duration == 0 {
+			c.Discovery.Interval.Duration = 10 * time.Minute
+		}
+	}
+	if set["destination"] || set["d"] {
+		for i := range c.Destinations {
+			c.Destinations[i].FilePattern = paramFolderPatern
+		}
+	}
+	for i := range c.Destinations {
+		c.Destinations[i].SetDefaults()
+	}
+}
+
+// Read the configuration file again, the running configuration is kept
+// when the new one is not valid.
+func ReloadConfig() (*Config, error) {
+	defer Un(Trace("ReloadConfig", paramConfigFile))
+	c, err := LoadConfig(paramConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	c.MergeFlags(flagsSet)
+	if err = c.Check(); err != nil {
+		return nil, err
+	}
+	if CheckOCRDependencies(c) {
+		return nil, NewDocumentError("ReloadConfig", "One or many depencies are not found")
+	}
+	SetCurrentConfig(c)
+	return c, nil
+}
+
+// The running configuration. A configuration is never modified once it has
+// been published, batches in progress keep the one they have started with.
+func CurrentConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+func SetCurrentConfig(c *Config) {
+	configLock.Lock()
+	config = c
+	if configChanged != nil {
+		close(configChanged)
+	}
+	configChanged = make(chan bool)
+	configLock.Unlock()
+}
+
+// The returned channel is closed when a new configuration is in place
+func ConfigChanged() <-chan bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return configChanged
+}
+
+// Check the configuration, name patterns are expanded to detect issues immediatly
+func (c *Config) Check() error {
+	if c.RetryMin.Duration < 0 || c.RetryMax.Duration < c.RetryMin.Duration {
+		return NewDocumentError("Config.Check", fmt.Sprint("invalid retry delays ", c.RetryMin, " ", c.RetryMax))
+	}
+	if c.Workers < 0 {
+		return NewDocumentError("Config.Check", fmt.Sprint("invalid number of workers ", c.Workers))
+	}
+	names := make(map[string]bool)
+	for _, d := range c.Destinations {
+		if d.Name == "" {
+			return NewDocumentError("Config.Check", "destination without name")
+		}
+		if names[d.Name] {
+			return NewDocumentError("Config.Check", "duplicate destination "+d.Name)
+		}
+		names[d.Name] = true
+		if d.FilePattern == "" {
+			return NewDocumentError("Config.Check", "no filepattern for destination "+d.Name)
+		}
+		s, err := ExpandString(d.FilePattern, time.Now())
+		if err != nil {
+			return NewDocumentError("Config.Check", "destination "+d.Name, err)
+		}
+		if s, err = ExpandHome(s, d.Owner); err != nil {
+			return NewDocumentError("Config.Check", "destination "+d.Name, err)
+		}
+		if _, err = d.Permissions(); err != nil {
+			return err
+		}
+		TRACE.Println("Destination", d.Name, "saves to", s)
+		switch d.ColorSpace {
+		case "Gray", "Color", colorSpaceAuto:
+		default:
+			return NewDocumentError("Config.Check", "unknown colorspace "+d.ColorSpace+" for destination "+d.Name)
+		}
+		if d.PSM != nil && (*d.PSM < 0 || *d.PSM > 13) {
+			return NewDocumentError("Config.Check", fmt.Sprint("invalid psm ", *d.PSM, " for destination ", d.Name))
+		}
+		if d.OEM != nil && (*d.OEM < 0 || *d.OEM > 3) {
+			return NewDocumentError("Config.Check", fmt.Sprint("invalid oem ", *d.OEM, " for destination ", d.Name))
+		}
+		if d.VersoGap != nil && d.VersoGap.Duration < 0 || d.VersoTolerance != nil && *d.VersoTolerance < 0 {
+			return NewDocumentError("Config.Check", "invalid verso gap or tolerance for destination "+d.Name)
+		}
+		if !contains([]string{collisionCounter, collisionOverwrite, collisionFail}, d.CollisionPolicy()) {
+			return NewDocumentError("Config.Check", "unknown collision policy "+d.Collision+" for destination "+d.Name)
+		}
+		if !contains([]string{versoPad, versoMatch, versoSeparate}, d.VersoPolicy) {
+			return NewDocumentError("Config.Check", "unknown verso policy "+d.VersoPolicy+" for destination "+d.Name)
+		}
+		if !contains([]string{"", blankKeep, blankRemove, blankMark}, d.Blank) {
+			return NewDocumentError("Config.Check", "unknown blank page mode "+d.Blank+" for destination "+d.Name)
+		}
+		if _, err = d.BlankInkThreshold(); err != nil {
+			return err
+		}
+		if d.BlankWords < 0 {
+			return NewDocumentError("Config.Check", "invalid blankwords for destination "+d.Name)
+		}
+		if !contains([]string{"", separatorPatch, separatorQR, separatorAny}, d.Separator) {
+			return NewDocumentError("Config.Check", "unknown separator "+d.Separator+" for destination "+d.Name)
+		}
+		if err = d.Compression.Check(&d); err != nil {
+			return err
+		}
+		if err = d.CheckPipeline(); err != nil {
+			return err
+		}
+	}
+	if c.Discovery != nil {
+		if err := c.Discovery.Check(); err != nil {
+			return err
+		}
+	}
+	return c.CheckDevices()
+}
+
+// Give the destination corresponding to settings registered on the printer
+func (c *Config) Destination(settings *hpdevices.DestinationSettings) *Destination {
+	if d := c.destination(settings.Name); d != nil {
+		return d
+	}
+	// The destination has been removed from the configuration since its registration
+	d := &Destination{
+		Name:        settings.Name,
+		FilePattern: *settings.FilePattern,
+		DoOCR:       settings.DoOCR,
+		Verso:       settings.Verso,
+		Resolution:  settings.Resolution,
+		ColorSpace:  settings.ColorSpace,
+	}
+	d.SetDefaults()
+	return d
+}
+
+func (c *Config) destination(name string) *Destination {
+	for i := range c.Destinations {
+		if c.Destinations[i].Name == name {
+			return &c.Destinations[i]
+		}
+	}
+	return nil
+}
+
+// Arguments given to tesseract for this destination
+func (d *Destination) TesseractOptions() []string {
+	args := []string{"-l", strings.Join(d.Languages, "+")}
+	if d.PSM != nil {
+		args = append(args, "--psm", strconv.Itoa(*d.PSM))
+	}
+	if d.OEM != nil {
+		args = append(args, "--oem", strconv.Itoa(*d.OEM))
+	}
+	return args
+}
+
+func (d *Destination) HasStep(name string) bool {
+	for _, s := range d.Steps {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the destination list to be registered on the printer
+func (c *Config) DestinationSettings() []hpdevices.DestinationSettings {
+	s := make([]hpdevices.DestinationSettings, len(c.Destinations))
+	for i := range c.Destinations {
+		d := &c.Destinations[i]
+		s[i] = hpdevices.DestinationSettings{
+			Name:        d.Name,
+			FilePattern: &d.FilePattern,
+			DoOCR:       d.DoOCR,
+			Verso:       d.Verso,
+			Resolution:  d.Resolution,
+			ColorSpace:  d.ColorSpace,
+		}
+		if d.ColorSpace == colorSpaceAuto {
+			// Pages are scanned in color, the colormode step chooses their mode
+			s[i].ColorSpace = "Color"
+		}
+	}
+	return s
+}
+
+var (
+	configLock    sync.RWMutex
+	config        *Config
+	configChanged chan bool
+	flagsSet      map[string]bool
+)
+
+// Flags given on the command line
+func SetFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
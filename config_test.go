@@ -0,0 +1,234 @@
+// config_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "scantopc-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+func Test_LoadConfig(t *testing.T) {
+	name := writeTestConfig(t, `
+name = "office"
+
+[[destination]]
+name = "OCR"
+filepattern = "/tmp/%Y%m%d-%H%M%S"
+ocr = true
+
+[[destination]]
+name = "Photo"
+filepattern = "/tmp/photo-%Y%m%d-%H%M%S"
+resolution = 600
+colorspace = "Color"
+`)
+	defer os.Remove(name)
+
+	c, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MergeFlags(map[string]bool{})
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Destinations) != 2 {
+		t.Fatalf("expecting 2 destinations, got %d", len(c.Destinations))
+	}
+	if d := c.Destinations[0]; d.Resolution != 300 || d.ColorSpace != "Gray" || !d.DoOCR {
+		t.Errorf("defaults not applied: %+v", d)
+	}
+	if d := c.Destinations[1]; d.Resolution != 600 || d.ColorSpace != "Color" || d.DoOCR {
+		t.Errorf("unexpected settings: %+v", d)
+	}
+	s := c.DestinationSettings()
+	if *s[1].FilePattern != "/tmp/photo-%Y%m%d-%H%M%S" {
+		t.Errorf("unexpected pattern %s", *s[1].FilePattern)
+	}
+}
+
+func Test_ConfigFlagsOverride(t *testing.T) {
+	name := writeTestConfig(t, `
+[[destination]]
+name = "OCR"
+filepattern = "/tmp/%Y%m%d-%H%M%S"
+`)
+	defer os.Remove(name)
+
+	c, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := paramFolderPatern
+	defer func() { paramFolderPatern = saved }()
+	paramFolderPatern = "/srv/scans/%Y/%H%M%S"
+	c.MergeFlags(map[string]bool{"destination": true})
+	if c.Destinations[0].FilePattern != paramFolderPatern {
+		t.Errorf("flag -destination not applied, got %s", c.Destinations[0].FilePattern)
+	}
+}
+
+func Test_ConfigCheck(t *testing.T) {
+	for _, content := range []string{
+		"[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y/%W\"\n",
+		"[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y\"\n[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y\"\n",
+		"[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y\"\ncolorspace = \"Sepia\"\n",
+	} {
+		name := writeTestConfig(t, content)
+		c, err := LoadConfig(name)
+		os.Remove(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.MergeFlags(map[string]bool{})
+		if err = c.Check(); err == nil {
+			t.Errorf("expecting an error for configuration\n%s", content)
+		}
+	}
+	name := writeTestConfig(t, "[[destination]]\nname = \"OCR\"\nfilepatern = \"/tmp/%Y\"\n")
+	defer os.Remove(name)
+	if _, err := LoadConfig(name); err == nil {
+		t.Error("expecting an error for unknown key")
+	}
+}
+
+func Test_ReloadConfig(t *testing.T) {
+	name := writeTestConfig(t, "ocr = false\n[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y\"\n")
+	defer os.Remove(name)
+	saved := paramConfigFile
+	defer func() { paramConfigFile = saved }()
+	paramConfigFile = name
+
+	running, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(name, []byte("ocr = false\n[[destination]]\nname = \"OCR\"\nfilepattern = \"/tmp/%Y/%W\"\n"), 0644)
+	if _, err = ReloadConfig(); err == nil {
+		t.Error("expecting an error for bad pattern")
+	}
+	if CurrentConfig() != running {
+		t.Error("running configuration has been replaced by a bad one")
+	}
+}
+
+func Test_TesseractOptions(t *testing.T) {
+	name := writeTestConfig(t, `
+[[destination]]
+name = "OCR (Deutsch+English)"
+filepattern = "/tmp/%Y"
+languages = ["deu", "eng"]
+psm = 6
+oem = 1
+`)
+	defer os.Remove(name)
+	c, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MergeFlags(map[string]bool{})
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(c.Destinations[0].TesseractOptions(), " ")
+	if got != "-l deu+eng --psm 6 --oem 1" {
+		t.Errorf("unexpected tesseract options %q", got)
+	}
+	d := Destination{}
+	c = &Config{Destinations: []Destination{d}}
+	c.MergeFlags(map[string]bool{})
+	if got = strings.Join(c.Destinations[0].TesseractOptions(), " "); got != "-l fra" {
+		t.Errorf("unexpected default tesseract options %q", got)
+	}
+}
+
+func Test_ConfigColorSpaceAuto(t *testing.T) {
+	name := writeTestConfig(t, `
+[[destination]]
+name = "Mail"
+filepattern = "/tmp/%Y%m%d-%H%M%S"
+ocr = true
+colorspace = "Auto"
+`)
+	defer os.Remove(name)
+
+	c, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MergeFlags(map[string]bool{})
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	steps := []string{}
+	for _, s := range c.Destinations[0].Steps {
+		steps = append(steps, s.Name)
+	}
+	if strings.Join(steps, ",") != "deskew,ocr,colormode,make-pdf" {
+		t.Errorf("unexpected pipeline %v", steps)
+	}
+	if s := c.DestinationSettings(); s[0].ColorSpace != "Color" {
+		t.Errorf("pages must be scanned in color, got %s", s[0].ColorSpace)
+	}
+}
+
+func Test_ConfigStrictVerso(t *testing.T) {
+	name := writeTestConfig(t, `
+[[destination]]
+name = "Verso"
+filepattern = "/tmp/%Y%m%d-%H%M%S"
+verso = true
+versogap = "0s"
+versotolerance = 0
+
+[[destination]]
+name = "Default"
+filepattern = "/tmp/%Y%m%d-%H%M%S"
+verso = true
+`)
+	defer os.Remove(name)
+
+	c, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MergeFlags(map[string]bool{})
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Destinations[0]; d.VersoGap.Duration != 0 || *d.VersoTolerance != 0 {
+		t.Errorf("explicit settings not kept: %v %v", d.VersoGap, *d.VersoTolerance)
+	}
+	if d := c.Destinations[1]; d.VersoGap.Duration != 15*time.Minute || *d.VersoTolerance != 1 {
+		t.Errorf("defaults not applied: %v %v", d.VersoGap, *d.VersoTolerance)
+	}
+}
+
+func Test_ConfigNoFile(t *testing.T) {
+	saved := paramFolderPatern
+	defer func() { paramFolderPatern = saved }()
+	paramFolderPatern = ""
+	c, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MergeFlags(map[string]bool{})
+	if err = c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Destinations) != 2 || c.Destinations[1].VersoPolicy != versoSeparate || c.Destinations[0].Collision != collisionCounter {
+		t.Errorf("unexpected destinations %+v", c.Destinations)
+	}
+}
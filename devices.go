@@ -0,0 +1,215 @@
+// devices.go
+package main
+
+/*
+	Several MFP served by the same instance
+
+	Printers are given by the -printer flag as a comma separated list of URLs,
+	or by [[device]] tables of the configuration file. Each device can restrict
+	the destinations registered on its panel:
+
+		[[device]]
+		url = "http://192.168.1.20:8080"
+		destinations = ["OCR", "OCR (Verso)"]   # all destinations when omitted
+
+	When no printer is given, devices are searched on the network by
+	discoverers given in [discovery] section, or localized by hpdevices.
+	Each device is handled by its own go routine.
+*/
+
+import (
+	"fmt"
+	"github.com/simulot/hpdevices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Device struct {
+	URL          string   `toml:"url"`
+	Destinations []string `toml:"destinations"`
+}
+
+// Devices to be served. An empty URL means the device is localized by hpdevices
+func (c *Config) DeviceList() []Device {
+	l := []Device{}
+	for _, u := range strings.Split(c.PrinterURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			l = append(l, Device{URL: u})
+		}
+	}
+	l = append(l, c.Devices...)
+	if len(l) == 0 && c.Discovery == nil {
+		l = append(l, Device{})
+	}
+	return l
+}
+
+// Give the device settings for the URL
+func (c *Config) Device(url string) *Device {
+	for _, d := range c.DeviceList() {
+		if d.URL == url {
+			return &d
+		}
+	}
+	return nil
+}
+
+// Check devices list
+func (c *Config) CheckDevices() error {
+	urls := make(map[string]bool)
+	for _, d := range c.DeviceList() {
+		if urls[d.URL] {
+			return NewDocumentError("Config.CheckDevices", "device "+d.URL+" is given twice")
+		}
+		urls[d.URL] = true
+		for _, n := range d.Destinations {
+			if c.destination(n) == nil {
+				return NewDocumentError("Config.CheckDevices", fmt.Sprint("unknown destination '", n, "' for device ", d.URL))
+			}
+		}
+	}
+	return nil
+}
+
+// Build the destination list to be registered on the device
+func (c *Config) DeviceDestinationSettings(url string) []hpdevices.DestinationSettings {
+	all := c.DestinationSettings()
+	d := c.Device(url)
+	if d == nil || len(d.Destinations) == 0 {
+		return all
+	}
+	s := []hpdevices.DestinationSettings{}
+	for _, ds := range all {
+		if contains(d.Destinations, ds.Name) {
+			s = append(s, ds)
+		}
+	}
+	return s
+}
+
+// Launch a go routine for each device, and wait for them
+func ServeDevices() {
+	defer Un(Trace("ServeDevices"))
+	var wg sync.WaitGroup
+	serve := func(url string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			DeviceLoop(url)
+		}()
+	}
+	c := CurrentConfig()
+	for _, d := range c.DeviceList() {
+		serve(d.URL)
+	}
+	if c.Discovery != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			DiscoveryLoop(serve)
+		}()
+	}
+	wg.Wait()
+}
+
+// Connect to the device and serve it. Any failure is kept local to the device
+func DeviceLoop(url string) {
+	defer Un(Trace("DeviceLoop", url))
+	for {
+		if to := deviceMoved(url); to != "" {
+			INFO.Println("Device", url, "is now served at", to)
+			supervisor.Forget(url)
+			return
+		}
+		err := connectAndServe(url)
+		if err == nil {
+			err = NewDocumentError("DeviceLoop", "connection closed")
+		}
+		time.Sleep(supervisor.Failed(url, err))
+	}
+}
+
+func connectAndServe(url string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewDocumentError("DeviceLoop", fmt.Sprint("device ", url, " has failed: ", r))
+		}
+	}()
+
+	var Scanner *hpdevices.HPDevice
+	next := supervisor.NextURL(url)
+	if next != "" {
+		TRACE.Println("Connection to the printer", next)
+		Scanner, err = hpdevices.NewHPDevice(next)
+	}
+	if url == "" && (next == "" || err != nil) {
+		TRACE.Println("Searching printer on the network")
+		Scanner, err = hpdevices.LocalizeDevice()
+	}
+	if err != nil {
+		return err
+	}
+	INFO.Println("Found device at", Scanner.URL)
+	supervisor.Connected(url, Scanner.URL)
+	return ScanToPC(url, Scanner)
+}
+
+// Scan to PC session of hpdevices, replaced by tests
+var newScanToPC = hpdevices.NewScanToPC
+
+// Register destinations on the printer and handle scan jobs until the device
+// is lost. hpdevices sessions can't be stopped: the session is kept when the
+// configuration is reloaded, and each batch takes the settings of its
+// destination from the current configuration. Destinations added or removed
+// are registered at the next connection to the device.
+func ScanToPC(url string, Scanner *hpdevices.HPDevice) error {
+	defer Un(Trace("ScanToPC", Scanner.URL))
+	changed := ConfigChanged()
+	c := CurrentConfig()
+	registered := c.DeviceDestinationSettings(url)
+	factory := func(doctype string, settings *hpdevices.DestinationSettings, format string, previousbatch hpdevices.DocumentBatchHandler) (hpdevices.DocumentBatchHandler, error) {
+		for _, ds := range CurrentConfig().DeviceDestinationSettings(url) {
+			if ds.Name == settings.Name {
+				settings = &ds
+				break
+			}
+		}
+		return NewOCRBatchImageManager(doctype, settings, format, previousbatch)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- NewDocumentError("ScanToPC", fmt.Sprint("device ", url, " has failed: ", r))
+			}
+		}()
+		_, err := newScanToPC(Scanner, factory, c.ComputerName, registered)
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-changed:
+		}
+		changed = ConfigChanged()
+		if sameDestinationNames(registered, CurrentConfig().DeviceDestinationSettings(url)) {
+			INFO.Println("New settings of", Scanner.URL, "destinations apply to next batches")
+		} else {
+			WARNING.Println("Destinations of", Scanner.URL, "have changed, they are registered at next connection")
+		}
+	}
+}
+
+func sameDestinationNames(a, b []hpdevices.DestinationSettings) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+// devices_test.go
+package main
+
+import (
+	"errors"
+	"github.com/simulot/hpdevices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_DeviceDestinations(t *testing.T) {
+	c := &Config{
+		PrinterURL: "http://10.0.0.1:8080, http://10.0.0.2:8080",
+		Devices: []Device{
+			Device{URL: "http://10.0.1.1:8080", Destinations: []string{"OCR"}},
+		},
+		Destinations: DefaultDestinations("/tmp/%Y%m%d-%H%M%S"),
+	}
+	c.MergeFlags(map[string]bool{})
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if l := c.DeviceList(); len(l) != 3 || l[1].URL != "http://10.0.0.2:8080" {
+		t.Errorf("unexpected device list %v", l)
+	}
+	if s := c.DeviceDestinationSettings("http://10.0.0.1:8080"); len(s) != 2 {
+		t.Errorf("expecting all destinations, got %v", s)
+	}
+	if s := c.DeviceDestinationSettings("http://10.0.1.1:8080"); len(s) != 1 || s[0].Name != "OCR" {
+		t.Errorf("expecting OCR destination only, got %v", s)
+	}
+
+	c.Devices[0].Destinations = []string{"Photo"}
+	if err := c.Check(); err == nil {
+		t.Error("expecting an error for unknown destination")
+	}
+	c.Devices[0].Destinations = nil
+	c.Devices[0].URL = "http://10.0.0.2:8080"
+	if err := c.Check(); err == nil {
+		t.Error("expecting an error for duplicate device")
+	}
+}
+
+func Test_DeviceDiscovery(t *testing.T) {
+	c := &Config{}
+	if l := c.DeviceList(); len(l) != 1 || l[0].URL != "" {
+		t.Errorf("expecting a discovered device, got %v", l)
+	}
+}
+
+func Test_ScanToPCReload(t *testing.T) {
+	c := &Config{Destinations: DefaultDestinations("/tmp/%Y%m%d-%H%M%S")}
+	c.MergeFlags(map[string]bool{})
+	SetCurrentConfig(c)
+
+	saved := newScanToPC
+	defer func() { newScanToPC = saved }()
+	var lock sync.Mutex
+	sessions := 0
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	newScanToPC = func(d *hpdevices.HPDevice, f hpdevices.DocumentBatchHandlerFactory, name string, dest []hpdevices.DestinationSettings) (*hpdevices.ScanToPC, error) {
+		lock.Lock()
+		sessions++
+		lock.Unlock()
+		started <- true
+		<-release
+		return nil, errors.New("session closed")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ScanToPC("", &hpdevices.HPDevice{URL: "http://10.0.0.1:8080"}) }()
+	<-started
+	for i := 0; i < 2; i++ {
+		c = &Config{Destinations: DefaultDestinations("/tmp/%Y%m%d-%H%M%S")}
+		c.MergeFlags(map[string]bool{})
+		SetCurrentConfig(c)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("session left after configuration change: %v", err)
+	case <-started:
+		t.Fatal("new session started after configuration change")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Lock()
+	if sessions != 1 {
+		t.Errorf("expecting one session, got %d", sessions)
+	}
+	lock.Unlock()
+
+	close(release)
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "session closed" {
+			t.Errorf("expecting the session error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session end not reported")
+	}
+}
@@ -0,0 +1,589 @@
+// discovery.go
+package main
+
+/*
+	Device discovery
+
+	Devices can be found by several means, configured in the [discovery]
+	section of the configuration file:
+
+		[discovery]
+		static = ["http://192.168.1.20:8080"]   # Known devices
+		dnssd = true                            # Browse _uscan._tcp and _pdl-datastream._tcp
+		subnets = ["192.168.10.0/24"]           # Probe HP LEDM discovery tree on each address, IPv4 up to /16
+		timeout = "3s"
+		interval = "10m"                        # Search again for new devices
+
+	Results of all discoverers are merged, a device found several times is
+	identified by its UUID. A device found at a new URL, after a change of its
+	DHCP lease for instance, is served at the new URL.
+	When there is no [discovery] section, the device is localized by hpdevices.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default port of HP LEDM web services
+const ledmPort = "8080"
+
+type DiscoveredDevice struct {
+	UUID string
+	URL  string
+}
+
+type Discoverer interface {
+	Discover(timeout time.Duration) ([]DiscoveredDevice, error)
+}
+
+type DiscoveryConfig struct {
+	Static   []string `toml:"static"`
+	DNSSD    bool     `toml:"dnssd"`
+	Subnets  []string `toml:"subnets"`
+	Timeout  duration `toml:"timeout"`
+	Interval duration `toml:"interval"`
+}
+
+// Build discoverers given by the configuration
+func (dc *DiscoveryConfig) Discoverers() []Discoverer {
+	l := []Discoverer{}
+	if len(dc.Static) > 0 {
+		l = append(l, StaticDiscoverer(dc.Static))
+	}
+	if dc.DNSSD {
+		l = append(l, NewDNSSDDiscoverer())
+	}
+	for _, s := range dc.Subnets {
+		l = append(l, &SubnetDiscoverer{CIDR: s, Port: ledmPort})
+	}
+	return l
+}
+
+func (dc *DiscoveryConfig) Check() error {
+	for _, s := range dc.Subnets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return NewDocumentError("DiscoveryConfig.Check", "subnet "+s, err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits != 32 {
+			return NewDocumentError("DiscoveryConfig.Check", "subnet "+s+" isn't an IPv4 range")
+		}
+		if ones < maxSubnetOnes {
+			return NewDocumentError("DiscoveryConfig.Check", fmt.Sprint("subnet ", s, " is larger than /", maxSubnetOnes))
+		}
+	}
+	if len(dc.Static) == 0 && !dc.DNSSD && len(dc.Subnets) == 0 {
+		return NewDocumentError("DiscoveryConfig.Check", "no discovery method given")
+	}
+	return nil
+}
+
+// Run all discoverers and merge their results. Devices are identified by their UUID.
+func Discover(discoverers []Discoverer, timeout time.Duration) []DiscoveredDevice {
+	defer Un(Trace("Discover"))
+	results := make([][]DiscoveredDevice, len(discoverers))
+	var wg sync.WaitGroup
+	for i, d := range discoverers {
+		wg.Add(1)
+		go func(i int, d Discoverer) {
+			defer wg.Done()
+			l, err := d.Discover(timeout)
+			if err != nil {
+				WARNING.Println("Discovery", fmt.Sprintf("%T", d), err)
+			}
+			results[i] = l
+		}(i, d)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	l := []DiscoveredDevice{}
+	for _, r := range results {
+		for _, d := range r {
+			key := normalizeUUID(d.UUID)
+			if key == "" {
+				key = d.URL
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			TRACE.Println("Discovered device", d.UUID, "at", d.URL)
+			l = append(l, d)
+		}
+	}
+	return l
+}
+
+// Search periodically devices on the network, and serve new ones
+func DiscoveryLoop(serve func(url string)) {
+	defer Un(Trace("DiscoveryLoop"))
+	known := newKnownDevices()
+	for _, d := range CurrentConfig().DeviceList() {
+		known.served[d.URL] = true
+	}
+	for {
+		changed := ConfigChanged()
+		dc := CurrentConfig().Discovery
+		if dc == nil {
+			// Discovery removed from the configuration, devices found are still served
+			INFO.Println("Discovery is disabled until the configuration gives it again")
+			<-changed
+			continue
+		}
+		for _, d := range Discover(dc.Discoverers(), dc.Timeout.Duration) {
+			known.add(d, serve)
+		}
+		time.Sleep(dc.Interval.Duration)
+	}
+}
+
+// Devices served by the discovery loop, by URL and by UUID
+type knownDevices struct {
+	served map[string]bool
+	urls   map[string]string // URL of each UUID
+}
+
+func newKnownDevices() *knownDevices {
+	return &knownDevices{served: make(map[string]bool), urls: make(map[string]string)}
+}
+
+// Serve a new device. A device found at a new URL is served at the new URL,
+// the loop of its previous URL ends.
+func (k *knownDevices) add(d DiscoveredDevice, serve func(url string)) {
+	key := normalizeUUID(d.UUID)
+	if previous, ok := k.urls[key]; key != "" && ok {
+		if previous == d.URL {
+			return
+		}
+		INFO.Println("Device", d.UUID, "has moved from", previous, "to", d.URL)
+		moveDevice(previous, d.URL)
+		k.served[previous] = false
+	} else if k.served[d.URL] {
+		// Given by the configuration, or another device at the same URL
+		return
+	} else {
+		INFO.Println("New device", d.UUID, "found at", d.URL)
+	}
+	if key != "" {
+		k.urls[key] = d.URL
+	}
+	if cancelMove(d.URL) {
+		// Back to its URL before the end of the loop serving it
+		k.served[d.URL] = true
+		return
+	}
+	if k.served[d.URL] {
+		return
+	}
+	k.served[d.URL] = true
+	serve(d.URL)
+}
+
+// Devices found at a new URL, the loop serving the previous URL ends
+var movedDevices = struct {
+	sync.Mutex
+	urls map[string]string
+}{urls: make(map[string]string)}
+
+func moveDevice(from, to string) {
+	movedDevices.Lock()
+	defer movedDevices.Unlock()
+	movedDevices.urls[from] = to
+}
+
+// Give the new URL of a moved device, the move is acknowledged
+func deviceMoved(url string) string {
+	movedDevices.Lock()
+	defer movedDevices.Unlock()
+	to := movedDevices.urls[url]
+	delete(movedDevices.urls, url)
+	return to
+}
+
+// Keep the loop of the URL when the move isn't acknowledged yet
+func cancelMove(url string) bool {
+	movedDevices.Lock()
+	defer movedDevices.Unlock()
+	_, ok := movedDevices.urls[url]
+	delete(movedDevices.urls, url)
+	return ok
+}
+
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(uuid), "urn:uuid:"))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Static list of URL
+
+type StaticDiscoverer []string
+
+func (s StaticDiscoverer) Discover(timeout time.Duration) ([]DiscoveredDevice, error) {
+	l := []DiscoveredDevice{}
+	var lastErr error
+	for _, url := range s {
+		d, err := ProbeLEDM(url, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		l = append(l, d)
+	}
+	return l, lastErr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// HP LEDM discovery tree
+
+// Check that the URL is an HP device, and get its UUID
+func ProbeLEDM(url string, timeout time.Duration) (d DiscoveredDevice, err error) {
+	client := http.Client{Timeout: timeout}
+	url = strings.TrimRight(url, "/")
+	tree, err := getXML(client, url+"/DevMgmt/DiscoveryTree.xml")
+	if err != nil {
+		return d, err
+	}
+	if tree.XMLName.Local != "DiscoveryTree" {
+		return d, NewDocumentError("ProbeLEDM", url+" doesn't provide an LEDM discovery tree")
+	}
+	d.URL = url
+	d.UUID = tree.UUID()
+	if d.UUID == "" {
+		// The UUID is given by product configuration
+		if cfg, err := getXML(client, url+"/DevMgmt/ProductConfigDyn.xml"); err == nil {
+			d.UUID = cfg.UUID()
+		}
+	}
+	return d, nil
+}
+
+// Generic XML element
+type xmlNode struct {
+	XMLName  xml.Name
+	Content  string    `xml:",chardata"`
+	Children []xmlNode `xml:",any"`
+}
+
+// Search the first UUID element
+func (n *xmlNode) UUID() string {
+	if n.XMLName.Local == "UUID" {
+		return strings.TrimSpace(n.Content)
+	}
+	for i := range n.Children {
+		if u := n.Children[i].UUID(); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+func getXML(client http.Client, url string) (*xmlNode, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewDocumentError("getXML", url+" "+resp.Status)
+	}
+	n := new(xmlNode)
+	if err = xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(n); err != nil {
+		return nil, NewDocumentError("getXML", url, err)
+	}
+	return n, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Subnet probing
+
+type SubnetDiscoverer struct {
+	CIDR string
+	Port string
+}
+
+// Largest subnet probed, as a prefix length
+const maxSubnetOnes = 16
+
+// Number of addresses probed at the same time
+const probeConcurrency = 32
+
+func (s *SubnetDiscoverer) Discover(timeout time.Duration) ([]DiscoveredDevice, error) {
+	ip, ipnet, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+		l     = []DiscoveredDevice{}
+		sem   = make(chan bool, probeConcurrency)
+	)
+	for ip = ip.Mask(ipnet.Mask); ipnet.Contains(ip); ip = nextIP(ip) {
+		wg.Add(1)
+		sem <- true
+		go func(url string) {
+			defer func() { <-sem; wg.Done() }()
+			if d, err := ProbeLEDM(url, timeout); err == nil {
+				mutex.Lock()
+				l = append(l, d)
+				mutex.Unlock()
+			}
+		}("http://" + net.JoinHostPort(ip.String(), s.Port))
+	}
+	wg.Wait()
+	return l, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// DNS-SD browsing, using one shot multicast DNS queries (RFC 6762 §5.1)
+
+type DNSSDDiscoverer struct {
+	Address  string   // Multicast DNS address
+	Services []string // Browsed services
+	Port     string   // Port of found devices when the SRV record doesn't give it
+}
+
+func NewDNSSDDiscoverer() *DNSSDDiscoverer {
+	return &DNSSDDiscoverer{
+		Address:  "224.0.0.251:5353",
+		Services: []string{"_uscan._tcp.local.", "_pdl-datastream._tcp.local."},
+		Port:     ledmPort,
+	}
+}
+
+func (s *DNSSDDiscoverer) Discover(timeout time.Duration) ([]DiscoveredDevice, error) {
+	addr, err := net.ResolveUDPAddr("udp4", s.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.WriteTo(dnsQuery(s.Services), addr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	records := []dnsRecord{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		r, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			TRACE.Println("DNSSDDiscoverer", err)
+			continue
+		}
+		records = append(records, r...)
+	}
+	return s.devices(records), nil
+}
+
+// Assemble devices from PTR, SRV, TXT and A records. DNS names are case
+// insensitive.
+func (s *DNSSDDiscoverer) devices(records []dnsRecord) []DiscoveredDevice {
+	l := []DiscoveredDevice{}
+	for _, ptr := range records {
+		if ptr.Type != dnsTypePTR || !s.browsed(ptr.Name) {
+			continue
+		}
+		d := DiscoveredDevice{}
+		target, port := "", s.Port
+		for _, r := range records {
+			if !strings.EqualFold(r.Name, ptr.Target) {
+				continue
+			}
+			switch r.Type {
+			case dnsTypeSRV:
+				target = r.Target
+				if r.Port != 0 {
+					port = fmt.Sprint(r.Port)
+				}
+			case dnsTypeTXT:
+				for _, t := range r.Text {
+					if kv := strings.SplitN(t, "=", 2); len(kv) == 2 && strings.ToLower(kv[0]) == "uuid" {
+						d.UUID = kv[1]
+					}
+				}
+			}
+		}
+		for _, r := range records {
+			if r.Type == dnsTypeA && strings.EqualFold(r.Name, target) {
+				d.URL = "http://" + net.JoinHostPort(r.IP.String(), port)
+				break
+			}
+		}
+		if d.URL != "" {
+			l = append(l, d)
+		}
+	}
+	return l
+}
+
+func (s *DNSSDDiscoverer) browsed(name string) bool {
+	for _, service := range s.Services {
+		if strings.EqualFold(service, name) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string   // PTR and SRV
+	Port   uint16   // SRV
+	Text   []string // TXT
+	IP     net.IP   // A
+}
+
+// Build a query for PTR records of given names
+func dnsQuery(names []string) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(names)))
+	for _, n := range names {
+		b = append(b, dnsName(n)...)
+		b = append(b, 0, dnsTypePTR, 0, dnsClassIN)
+	}
+	return b
+}
+
+func dnsName(name string) []byte {
+	b := []byte{}
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func parseDNSMessage(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, NewDocumentError("parseDNSMessage", "message too short")
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	var err error
+	for i := 0; i < qd; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	l := []dnsRecord{}
+	for i := 0; i < rr; i++ {
+		r := dnsRecord{}
+		if r.Name, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, NewDocumentError("parseDNSMessage", "truncated record")
+		}
+		r.Type = binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, NewDocumentError("parseDNSMessage", "truncated record data")
+		}
+		data := msg[off : off+length]
+		switch r.Type {
+		case dnsTypePTR:
+			r.Target, _, err = readDNSName(msg, off)
+		case dnsTypeSRV:
+			if length < 6 {
+				return nil, NewDocumentError("parseDNSMessage", "bad SRV record")
+			}
+			r.Port = binary.BigEndian.Uint16(data[4:])
+			r.Target, _, err = readDNSName(msg, off+6)
+		case dnsTypeTXT:
+			for j := 0; j < len(data); {
+				n := int(data[j])
+				if j+1+n > len(data) {
+					break
+				}
+				r.Text = append(r.Text, string(data[j+1:j+1+n]))
+				j += 1 + n
+			}
+		case dnsTypeA:
+			if length == 4 {
+				r.IP = net.IP(append([]byte{}, data...))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		off += length
+		l = append(l, r)
+	}
+	return l, nil
+}
+
+// Read a possibly compressed name, give the offset following the name
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, NewDocumentError("readDNSName", "truncated name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, NewDocumentError("readDNSName", "bad compression pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, NewDocumentError("readDNSName", "truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// discovery_test.go
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake HP device answering LEDM discovery tree
+func fakeLEDM(uuid string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/DevMgmt/DiscoveryTree.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ledm:DiscoveryTree xmlns:ledm="http://www.hp.com/schemas/imaging/con/ledm/2007/09/21" xmlns:dd="http://www.hp.com/schemas/imaging/con/dictionaries/1.0/">
+	<ledm:SupportedTree><dd:ResourceURI>/DevMgmt/ProductConfigDyn.xml</dd:ResourceURI></ledm:SupportedTree>
+</ledm:DiscoveryTree>`))
+	})
+	mux.HandleFunc("/DevMgmt/ProductConfigDyn.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<prdcfgdyn:ProductConfigDyn xmlns:prdcfgdyn="http://www.hp.com/schemas/imaging/con/ledm/productconfigdyn/2007/11/05" xmlns:dd="http://www.hp.com/schemas/imaging/con/dictionaries/1.0/">
+	<prdcfgdyn:ProductInformation><dd:UUID>` + uuid + `</dd:UUID></prdcfgdyn:ProductInformation>
+</prdcfgdyn:ProductConfigDyn>`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func Test_StaticDiscoverer(t *testing.T) {
+	dev := fakeLEDM("1c852a4d-b800-1f08-abcd-9cb654000001")
+	defer dev.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+
+	l, err := StaticDiscoverer{dev.URL, other.URL}.Discover(time.Second)
+	if err == nil {
+		t.Error("expecting an error for non HP device")
+	}
+	if len(l) != 1 || l[0].URL != dev.URL || l[0].UUID != "1c852a4d-b800-1f08-abcd-9cb654000001" {
+		t.Errorf("unexpected result %+v", l)
+	}
+}
+
+func Test_SubnetDiscoverer(t *testing.T) {
+	dev := fakeLEDM("1c852a4d-b800-1f08-abcd-9cb654000002")
+	defer dev.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(dev.URL, "http://"))
+
+	l, err := (&SubnetDiscoverer{CIDR: "127.0.0.0/30", Port: port}).Discover(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].URL != dev.URL {
+		t.Errorf("unexpected result %+v", l)
+	}
+}
+
+// Encode a DNS resource record
+func dnsRR(name string, typ uint16, data []byte) []byte {
+	b := dnsName(name)
+	h := make([]byte, 10)
+	binary.BigEndian.PutUint16(h, typ)
+	binary.BigEndian.PutUint16(h[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(h[4:], 120)
+	binary.BigEndian.PutUint16(h[8:], uint16(len(data)))
+	return append(append(b, h...), data...)
+}
+
+// Fake mDNS responder, answering to any query with one printer
+func fakeMDNS(t *testing.T, uuid string) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := "Officejet 6700._uscan._tcp.local."
+	srv := []byte{0, 0, 0, 0, 0x1f, 0x91} // Port 8081
+	srv = append(srv, dnsName("officejet.local.")...)
+	txt := []byte{}
+	for _, s := range []string{"txtvers=1", "UUID=" + uuid, "rs=eSCL"} {
+		txt = append(append(txt, byte(len(s))), s...)
+	}
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 3)
+	msg = append(msg, dnsRR("_USCAN._tcp.local.", dnsTypePTR, dnsName(instance))...)
+	msg = append(msg, dnsRR(instance, dnsTypeSRV, srv)...)
+	msg = append(msg, dnsRR(instance, dnsTypeTXT, txt)...)
+	msg = append(msg, dnsRR("OfficeJet.local.", dnsTypeA, []byte{127, 0, 0, 1})...)
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(msg, addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_DNSSDDiscoverer(t *testing.T) {
+	d := NewDNSSDDiscoverer()
+	d.Address = fakeMDNS(t, "1C852A4D-B800-1F08-ABCD-9CB654000003")
+	l, err := d.Discover(500 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].URL != "http://127.0.0.1:8081" || l[0].UUID != "1C852A4D-B800-1F08-ABCD-9CB654000003" {
+		t.Errorf("unexpected result %+v", l)
+	}
+}
+
+type fakeDiscoverer []DiscoveredDevice
+
+func (f fakeDiscoverer) Discover(timeout time.Duration) ([]DiscoveredDevice, error) {
+	return f, nil
+}
+
+func Test_DiscoverMerge(t *testing.T) {
+	l := Discover([]Discoverer{
+		fakeDiscoverer{{UUID: "urn:uuid:AAAA", URL: "http://10.0.0.1:8080"}},
+		fakeDiscoverer{{UUID: "aaaa", URL: "http://printer.local:8080"}, {UUID: "bbbb", URL: "http://10.0.0.2:8080"}},
+	}, time.Second)
+	if len(l) != 2 || l[0].URL != "http://10.0.0.1:8080" || l[1].UUID != "bbbb" {
+		t.Errorf("unexpected result %+v", l)
+	}
+}
+
+func Test_DiscoveryLoopDisabled(t *testing.T) {
+	dev := fakeLEDM("1c852a4d-b800-1f08-abcd-9cb654000009")
+	defer dev.Close()
+	c := &Config{Discovery: &DiscoveryConfig{Static: []string{dev.URL}}}
+	c.MergeFlags(map[string]bool{})
+	SetCurrentConfig(c)
+
+	// Discovery removed by a reload, then given again
+	SetCurrentConfig(&Config{})
+	found := make(chan string, 1)
+	go DiscoveryLoop(func(url string) { found <- url })
+	time.Sleep(100 * time.Millisecond)
+	SetCurrentConfig(c)
+	select {
+	case url := <-found:
+		if url != dev.URL {
+			t.Errorf("unexpected device %s", url)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("discovery not resumed")
+	}
+}
+
+func Test_DiscoveredDeviceMoved(t *testing.T) {
+	k := newKnownDevices()
+	k.served["http://10.0.0.9:8080"] = true
+	served := []string{}
+	serve := func(url string) { served = append(served, url) }
+	for _, d := range []DiscoveredDevice{
+		{UUID: "aaaa", URL: "http://10.0.0.1:8080"},
+		{UUID: "urn:uuid:AAAA", URL: "http://10.0.0.1:8080"},
+		{UUID: "bbbb", URL: "http://10.0.0.9:8080"}, // Given by the configuration
+		{UUID: "aaaa", URL: "http://10.0.0.2:8080"},
+	} {
+		k.add(d, serve)
+	}
+	if len(served) != 2 || served[0] != "http://10.0.0.1:8080" || served[1] != "http://10.0.0.2:8080" {
+		t.Errorf("unexpected served devices %v", served)
+	}
+	if to := deviceMoved("http://10.0.0.1:8080"); to != "http://10.0.0.2:8080" {
+		t.Errorf("the loop of previous URL should end, got %q", to)
+	}
+	if to := deviceMoved("http://10.0.0.2:8080"); to != "" {
+		t.Errorf("the loop of the new URL should go on, got %q", to)
+	}
+
+	// Back to the first URL, once its loop has ended
+	k.add(DiscoveredDevice{UUID: "aaaa", URL: "http://10.0.0.1:8080"}, serve)
+	if len(served) != 3 || served[2] != "http://10.0.0.1:8080" {
+		t.Errorf("unexpected served devices %v", served)
+	}
+	// And back again before the end of the loop of the second URL
+	k.add(DiscoveredDevice{UUID: "aaaa", URL: "http://10.0.0.2:8080"}, serve)
+	k.add(DiscoveredDevice{UUID: "aaaa", URL: "http://10.0.0.1:8080"}, serve)
+	if len(served) != 3 {
+		t.Errorf("loops still running should be kept, got %v", served)
+	}
+	if deviceMoved("http://10.0.0.1:8080") != "" || deviceMoved("http://10.0.0.2:8080") != "http://10.0.0.1:8080" {
+		t.Error("only the loop of the second URL should end")
+	}
+}
+
+func Test_DiscoveryConfigSubnets(t *testing.T) {
+	for _, c := range []struct {
+		subnet string
+		valid  bool
+	}{
+		{"192.168.10.0/24", true},
+		{"10.1.0.0/16", true},
+		{"10.0.0.0/8", false},
+		{"fd00::/120", false},
+		{"192.168.10.0", false},
+	} {
+		dc := &DiscoveryConfig{Subnets: []string{c.subnet}}
+		if err := dc.Check(); (err == nil) != c.valid {
+			t.Errorf("%s: unexpected result %v", c.subnet, err)
+		}
+	}
+}
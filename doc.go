@@ -14,12 +14,17 @@ Flip it and chose destination having Verso. This will produce a doublesided pdf
 
 Tested with printer model Officejet 6700 on linux, freebsd.
 
-Usage of ./scantopc:
+Usage of ./scantopc [stop]:
+>   -config="": Configuration file (TOML) listing destinations
 >   -d="": shorthand for -destination
 >   -destination="": Folder where images are strored (see help for tokens)
 >   -name="localhost": Name of the computer visible on the printer (default: $hostname)
->   -printer="": Printer URL like http://1.2.3.4:8080, when omitted, the device is searched on the network
+>   -pidfile="/var/run/scantopc/scantopc.pid": PID file used in service mode and by the stop command
+>   -printer="": Printer URLs like http://1.2.3.4:8080, comma separated, when omitted, the device is searched on the network
+>   -service=false: Run as a service: write pid file, switch user, notify systemd
+>   -stoptimeout=3m0s: Time given to the running instance to stop
 >   -trace=false: Enable traces
+>   -user="": User running the service
 
 Allowed tokens for dir / file name are:
 	%Y  Year (4 digits):      2014
@@ -41,8 +46,6 @@ This litle piece of code is my first programming experience with Go language and
 - On Qnap ARM TS119:  SGEFAULT with saving as PDF (update: seems to by tied to QNAP and not ARM architecture. Need help here)
 
 # TODO:
-- Service mode: been able to run as a service in *nix world
-- Manage several MFP on the network.
 - better error management (still in progress)
 
 # CHANGE LOG
@@ -6,13 +6,15 @@ package main
 */
 
 import (
+	"archive/zip"
 	"fmt"
 	"github.com/simulot/hpdevices"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -43,13 +45,25 @@ func NewDocumentError(operation, message string, err ...error) error {
 type OCRBatchImageManager struct {
 	tempfolder    string
 	settings      *hpdevices.DestinationSettings
+	destination   *Destination
+	config        *Config // Configuration in use when the batch has started
 	doctype       string
 	format        string
 	previousbatch *OCRBatchImageManager
 	imagelist     []*imageJob
 	imageJobChan  chan *imageJob
-	filename      string // Final document name
+	filename      string   // Final document name
+	base          string   // Document name without extension, from the name pattern
+	files         []string // Files written for the document
 	when          time.Time
+	received      time.Time // Last page received
+	finalized     chan bool // Closed when the document is written
+	merged        bool      // Verso merged with the previous batch
+	split         bool      // Batch split by separator sheets
+	index         int       // Document of a split batch, from 1
+	title         string    // Title given by the separator sheet
+	task          *Task
+	journal       *Journal
 }
 
 func NewOCRBatchImageManager(doctype string, destination *hpdevices.DestinationSettings, format string, previousbatch hpdevices.DocumentBatchHandler) (bh hpdevices.DocumentBatchHandler, err error) {
@@ -58,6 +72,8 @@ func NewOCRBatchImageManager(doctype string, destination *hpdevices.DestinationS
 	INFO.Println("New scan batch started:", destination.Name, doctype)
 
 	bm.settings = destination
+	bm.config = CurrentConfig()
+	bm.destination = bm.config.Destination(destination)
 	bm.doctype = doctype
 	switch doctype {
 	case "Jpeg":
@@ -69,13 +85,23 @@ func NewOCRBatchImageManager(doctype string, destination *hpdevices.DestinationS
 		return nil, err
 	}
 
-	bm.tempfolder, err = ioutil.TempDir("", "scantopc")
+	spool := bm.config.SpoolFolder()
+	if err = os.MkdirAll(spool, 0755); err != nil {
+		return nil, NewDocumentError("NewOCRBatchImageManager", "", err)
+	}
+	bm.tempfolder, err = ioutil.TempDir(spool, batchFolderPrefix)
 	if err != nil {
 		return nil, NewDocumentError("NewOCRBatchImageManager", "", err)
 	}
 
 	TRACE.Println("Temp folder for this batch is", bm.tempfolder)
 	bm.when = time.Now()
+	bm.task, err = coordinator.Begin("batch", destination.Name+" "+bm.when.Format("2006-01-02 15:04:05"), bm.tempfolder)
+	if err != nil {
+		os.RemoveAll(bm.tempfolder)
+		return nil, err
+	}
+	bm.journal = NewJournal(bm)
 	if previousbatch != nil {
 		if bm.settings.Verso {
 			TRACE.Println("Verso batch and previous batch known")
@@ -84,18 +110,27 @@ func NewOCRBatchImageManager(doctype string, destination *hpdevices.DestinationS
 	}
 	bm.imagelist = make([]*imageJob, 0)
 	bm.imageJobChan = make(chan *imageJob)
+	bm.finalized = make(chan bool)
 	return hpdevices.DocumentBatchHandler(bm), nil
 }
 
 func (bm *OCRBatchImageManager) NewImageWriter() (file io.WriteCloser, err error) {
-	ij, err := NewImageJob(bm.tempfolder+"/"+fmt.Sprintf("page-%04d.jpg", len(bm.imagelist)), bm.imageJobChan)
+	ij, err := NewImageJob(bm.tempfolder+"/"+fmt.Sprintf("page-%04d.jpg", len(bm.imagelist)), bm.destination, bm.format, bm.imageJobChan)
+	if err != nil {
+		return nil, err
+	}
 	INFO.Println("Recieving page from scanner:", ij.filename)
+	ij.journal = bm.journal
+	ij.batch = bm.when
+	bm.journal.AddPage(ij.filename)
 	bm.imagelist = append(bm.imagelist, ij)
 	return ij, nil
 }
 
 func (bm *OCRBatchImageManager) CloseDocumentBatch() error {
 	TRACE.Println("Last page recieved")
+	bm.received = time.Now()
+	bm.journal.Close()
 	// Put here code to generate final pdf
 	go bm.FinalizeDocumentBatch()
 	return nil
@@ -103,6 +138,8 @@ func (bm *OCRBatchImageManager) CloseDocumentBatch() error {
 
 func (bm *OCRBatchImageManager) FinalizeDocumentBatch() {
 	defer Un(Trace("OCRBatchImageManager.FinalizeDocumentBatch"))
+	defer coordinator.End(bm.task)
+	defer bm.Finalized()
 	// This code is placed in a go routine to allow starting a new scan job while finishing OCR
 
 	// Wait for all image treatment finished
@@ -118,25 +155,78 @@ func (bm *OCRBatchImageManager) FinalizeDocumentBatch() {
 		}
 	}
 	INFO.Println("Last treatment for batch is finished")
-	_ = nbErr
+	if nbErr > 0 {
+		WARNING.Println(nbErr, "pages of", len(bm.imagelist), "have failed")
+	}
 	// At that point, all scanned images have been processed or are errored
+	document, imagelist := bm, bm.imagelist
 	if bm.previousbatch != nil {
 		prevBatch := bm.previousbatch
-		if bm.settings.Verso && len(prevBatch.imagelist) == len(bm.imagelist) {
-			newImageList := make([]*imageJob, 2*len(bm.imagelist))
-			for i := 0; i < len(bm.imagelist); i++ {
-				newImageList[2*i] = prevBatch.imagelist[i]
-				newImageList[2*i+1] = bm.imagelist[len(bm.imagelist)-i-1]
-			}
-			prevBatch.CombinePages(newImageList)
+		// Batches of a device are finalized in their scan order
+		prevBatch.Wait()
+		if bm.settings.Verso && prevBatch.merged {
+			INFO.Println("Verso", bm.when.Format("15:04:05"), "kept separate: previous batch is a verso already merged")
 			prevBatch.CleanUp()
+		} else if bm.settings.Verso && (prevBatch.split || HasSeparators(bm.imagelist)) {
+			INFO.Println("Verso", bm.when.Format("15:04:05"), "kept separate: batches with separator sheets can't be merged")
+			prevBatch.CleanUp()
+		} else if bm.settings.Verso {
+			pages, reason := VersoMerge(prevBatch.imagelist, bm.imagelist, bm.destination, bm.when.Sub(prevBatch.Received()))
+			if pages != nil {
+				if err := prevBatch.BlankPages(pages); err != nil {
+					ERROR.Println("Blank pages can't be created, verso kept separate", err)
+					pages = nil
+				}
+			}
+			if pages != nil {
+				INFO.Println("Verso", bm.when.Format("15:04:05"), "merged with recto", prevBatch.when.Format("15:04:05"), "of", prevBatch.settings.Name+":", reason)
+				document, imagelist = prevBatch, pages
+				bm.merged = true
+			} else {
+				INFO.Println("Verso", bm.when.Format("15:04:05"), "kept separate from recto", prevBatch.when.Format("15:04:05"), "of", prevBatch.settings.Name+":", reason)
+				prevBatch.CleanUp()
+			}
 		} else {
 			prevBatch.CleanUp()
-			bm.CombinePages(bm.imagelist)
 		}
-	} else {
-		bm.CombinePages(bm.imagelist)
+	} else if bm.settings.Verso {
+		INFO.Println("Verso", bm.when.Format("15:04:05"), "kept separate: no previous batch")
+	}
+	if bm.destination.Separator != "" && HasSeparators(imagelist) {
+		// Failed documents are quarantined one by one
+		if err := document.CombineDocuments(imagelist); err != nil {
+			ERROR.Println("OCRBatchImageManager.FinalizeDocumentBatch", err)
+		}
+	} else if err := document.CombinePages(imagelist); nbErr > 0 || err != nil {
+		document.Quarantine(imagelist, err)
+	}
+	if document != bm {
+		document.CleanUp()
+	}
+	bm.journal.Finish()
+	// Images are kept until next batch, it could be the verso
+	coordinator.Hold(bm.tempfolder)
+}
+
+// Wait until the document of the batch is written
+func (bm *OCRBatchImageManager) Wait() {
+	if bm.finalized != nil {
+		<-bm.finalized
+	}
+}
+
+func (bm *OCRBatchImageManager) Finalized() {
+	if bm.finalized != nil {
+		close(bm.finalized)
+	}
+}
+
+// Time when the last page has been received
+func (bm *OCRBatchImageManager) Received() time.Time {
+	if bm.received.IsZero() {
+		return bm.when
 	}
+	return bm.received
 }
 
 /*
@@ -145,6 +235,7 @@ func (bm *OCRBatchImageManager) FinalizeDocumentBatch() {
 
 func (bm *OCRBatchImageManager) CleanUp() error {
 	TRACE.Println("OCRBatchImageManager.CleanUp", bm.tempfolder)
+	coordinator.Release(bm.tempfolder)
 	err := os.RemoveAll(bm.tempfolder)
 	if err != nil {
 		ERROR.Println("OCRBatchImageManager.CleanUp", err)
@@ -153,43 +244,294 @@ func (bm *OCRBatchImageManager) CleanUp() error {
 }
 
 /*
-	Clean up tempory folder and errase final file.
+	Erase files of the previous version of the document that are not
+	replaced by the new one.
 	This is used when the previous image batch is combined with current
 
 */
 
-func (bm *OCRBatchImageManager) Erase() error {
-	os.RemoveAll(bm.tempfolder)
-	return os.Remove(bm.filename)
+func (bm *OCRBatchImageManager) Erase(replaced []string) (err error) {
+	for _, f := range bm.files {
+		if contains(replaced, f) {
+			continue
+		}
+		TRACE.Println("OCRBatchImageManager.Erase", f)
+		if e := os.Remove(f); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
-func (bm *OCRBatchImageManager) CombinePages(imagelist []*imageJob) {
-	var err error
-	bm.filename, err = ExpandString(*bm.settings.FilePattern, bm.when)
+// Name of the document without extension, given by the name pattern
+func (bm *OCRBatchImageManager) DocumentBase() (string, error) {
+	pattern := *bm.settings.FilePattern
+	if bm.index > 0 && !strings.Contains(pattern, "%i") && !strings.Contains(pattern, "%t") {
+		pattern += "-%i"
+	}
+	return ExpandName(pattern, bm.when, nameValues{index: bm.index, title: bm.title})
+}
+
+// Write the document with pages that can be used, failed pages are
+// included as plain images. A previous version of the document is replaced,
+// other existing files are handled following the destination collision
+// policy.
+func (bm *OCRBatchImageManager) CombinePages(imagelist []*imageJob) error {
+	replace := len(bm.files) > 0
+	base, err := bm.base, error(nil)
+	if !replace {
+		base, err = bm.DocumentBase()
+	}
 	if err != nil {
 		ERROR.Print("Name pattern is incorrect. Job discarded", err)
+		return err
+	}
+	perm, err := bm.destination.Permissions()
+	if err == nil && !replace {
+		if base, err = ExpandHome(base, bm.destination.Owner); err == nil {
+			err = MakeFolders(filepath.Dir(base), perm)
+		}
+	}
+	if err != nil {
+		ERROR.Println("OCRBatchImageManager.CombinePages", err)
+		return err
+	}
+	pages := []*imageJob{}
+	for _, ij := range imagelist {
+		if ij.lost {
+			ERROR.Println("Page", ij.filename, "is lost")
+			continue
+		}
+		pages = append(pages, ij)
+	}
+	if len(pages) == 0 {
+		return NewDocumentError("OCRBatchImageManager.CombinePages", "no page to write")
+	}
+	if pages = bm.BlankPageFilter(pages); len(pages) == 0 {
+		return NewDocumentError("OCRBatchImageManager.CombinePages", "all pages are blank")
+	}
+	overwrite := replace || bm.destination.CollisionPolicy() == collisionOverwrite
+	name := base
+	for n := 1; ; n++ {
+		bm.filename = bm.DocumentName(name)
+		out := &outputFiles{perm: perm, journal: bm.journal}
+		if _, err = os.Stat(bm.filename); err == nil && !overwrite {
+			err = &os.PathError{Op: "write", Path: bm.filename, Err: os.ErrExist}
+		} else {
+			err = bm.WriteDocument(name, pages, out)
+			if err == nil {
+				err = out.Commit(overwrite)
+			}
+			if err != nil {
+				out.Abort()
+			}
+		}
+		if err == nil {
+			bm.base = name
+			if replace {
+				bm.Erase(out.final)
+				INFO.Println("Document", bm.filename, "replaced")
+			}
+			bm.files = out.final
+			return nil
+		}
+		if !os.IsExist(err) || bm.destination.CollisionPolicy() != collisionCounter {
+			ERROR.Println("OCRBatchImageManager.CombinePages", err)
+			return err
+		}
+		name = fmt.Sprintf("%s-%d", base, n)
+		WARNING.Println("Document", bm.filename, "exists, trying", bm.DocumentName(name))
+	}
+}
+
+// Write files of the document under temporary names
+func (bm *OCRBatchImageManager) WriteDocument(base string, pages []*imageJob, out *outputFiles) error {
+	switch bm.format {
+	case ".jpg":
+		return bm.CreateJPEG(base, pages, out)
+	default:
+		return bm.CreatePDF(pages, out)
+	}
+}
+
+// Name of the document file, or of its first page for Jpeg documents
+func (bm *OCRBatchImageManager) DocumentName(base string) string {
+	switch {
+	case bm.format != ".jpg":
+		return base + bm.format
+	case bm.destination.Zip:
+		return base + ".zip"
+	default:
+		return JPEGPageName(base, 0) + bm.format
+	}
+}
+
+// Join PDF pages. pdfunite and pdftk are used when requested by -pdftool
+func (bm *OCRBatchImageManager) CreatePDF(imagelist []*imageJob, out *outputFiles) error {
+	filename, err := out.Create(bm.filename)
+	for _, ij := range imagelist {
+		// Pages are taken at their full quality, the document is fitted again
+		ij.fitted = ""
+	}
+	join := func() error {
+		switch bm.config.PDFTool {
+		case "pdfunite":
+			return CreatePDFUsingPDFunite(filename, imagelist)
+		case "pdftk":
+			return CreatePDFUsingPDFTK(filename, imagelist)
+		default:
+			return CreatePDFNative(filename, imagelist, bm.DocumentInfo(imagelist))
+		}
+	}
+	if err == nil {
+		err = join()
+	}
+	if err == nil {
+		err = bm.FitDocument(filename, imagelist, join)
+	}
+	if err != nil {
+		ERROR.Println("OCRBatchImageManager.CreatePDF", bm.filename, err)
+	}
+	return err
+}
+
+// Entries of the PDF information dictionary
+func (bm *OCRBatchImageManager) DocumentInfo(pages []*imageJob) map[string]string {
+	info := map[string]string{}
+	if bm.title != "" {
+		info["Title"] = bm.title
+	}
+	if l := BlankPageList(pages); l != "" {
+		info["BlankPages"] = l
 	}
+	if l := RotationList(pages); l != "" {
+		info["Rotations"] = l
+	}
+	return info
+}
+
+// Write each page as its own image, named from base with the page index.
+// Pages are bundled in a ZIP file when requested by the destination.
+func (bm *OCRBatchImageManager) CreateJPEG(base string, imagelist []*imageJob, out *outputFiles) error {
+	withText := bm.destination.DoOCR
+	if !bm.destination.Zip {
+		err := CreateJPEGFiles(base, imagelist, withText, out)
+		if err != nil {
+			ERROR.Println("OCRBatchImageManager.CreateJPEG", bm.filename, err)
+		}
+		return err
+	}
+	filename, err := out.Create(bm.filename)
 	if err == nil {
-		bm.filename += bm.format
-		bm.CreatePDF(imagelist)
+		err = CreateJPEGZip(filename, base, imagelist, withText, bm.when)
+	}
+	if err != nil {
+		ERROR.Println("OCRBatchImageManager.CreateJPEG", bm.filename, err)
+	}
+	return err
+}
+
+// Name of a page of a Jpeg document, without extension
+func JPEGPageName(base string, page int) string {
+	return fmt.Sprintf("%s-%03d", base, page+1)
+}
+
+// Copy page images next to each other. The text of OCRed pages is written
+// in a .txt file with the same name.
+func CreateJPEGFiles(base string, images []*imageJob, withText bool, out *outputFiles) error {
+	for i, ij := range images {
+		name := JPEGPageName(base, i)
+		filename, err := out.Create(name + ".jpg")
+		if err != nil {
+			return err
+		}
+		if _, err = CopyFile(ij.current, filename); err != nil {
+			return err
+		}
+		if !withText || ij.hocr == "" {
+			continue
+		}
+		if filename, err = out.Create(name + ".txt"); err != nil {
+			return err
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		err = HOCRToText(ij.hocr, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bundle page images, and their text when OCRed, in a ZIP file
+func CreateJPEGZip(filename, base string, images []*imageJob, withText bool, when time.Time) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return NewDocumentError("CreateJPEGZip", filename, err)
+	}
+	err = writeJPEGZip(f, filepath.Base(base), images, withText, when)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return NewDocumentError("CreateJPEGZip", filename, err)
+	}
+	return nil
+}
+
+func writeJPEGZip(f io.Writer, base string, images []*imageJob, withText bool, when time.Time) error {
+	zw := zip.NewWriter(f)
+	for i, ij := range images {
+		name := JPEGPageName(base, i)
+		// JPEG images are already compressed
+		h := &zip.FileHeader{Name: name + ".jpg", Method: zip.Store}
+		h.SetModTime(when)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		img, err := os.Open(ij.current)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, img)
+		img.Close()
+		if err != nil {
+			return err
+		}
+		if !withText || ij.hocr == "" {
+			continue
+		}
+		h = &zip.FileHeader{Name: name + ".txt", Method: zip.Deflate}
+		h.SetModTime(when)
+		if w, err = zw.CreateHeader(h); err != nil {
+			return err
+		}
+		if err = HOCRToText(ij.hocr, w); err != nil {
+			return err
+		}
 	}
+	return zw.Close()
 }
 
-func (bm *OCRBatchImageManager) CreatePDF(imagelist []*imageJob) {
-	switch paramPFDTool {
-	case "pdfunite":
-		CreatePDFUsingPDFunite(bm.filename, imagelist)
-	case "pdftk":
-		CreatePDFUsingPDFTK(bm.filename, imagelist)
+func CreatePDFNative(filename string, images []*imageJob, info map[string]string) error {
+	pages := make([]string, len(images))
+	for i := range images {
+		pages[i] = images[i].DocumentPDF()
 	}
+	return MergePDF(filename, pages, info)
 }
 
 func CreatePDFUsingPDFTK(filename string, images []*imageJob) error {
 	argList := make([]string, 0)
 	for i := 0; i < len(images); i++ {
-		p := images[i]
-		d, f := path.Split(p.filename)
-		argList = append(argList, d+"ocr-"+f+".pdf")
+		argList = append(argList, images[i].DocumentPDF())
 	}
 	arglist := append(argList, "cat", "output", filename)
 	cmd := exec.Command("pdftk", arglist...)
@@ -202,9 +544,7 @@ func CreatePDFUsingPDFunite(filename string, images []*imageJob) error {
 	if len(images) > 1 {
 		argList := make([]string, 0)
 		for i := 0; i < len(images); i++ {
-			p := images[i]
-			d, f := path.Split(p.filename)
-			argList = append(argList, d+"ocr-"+f+".pdf")
+			argList = append(argList, images[i].DocumentPDF())
 		}
 		arglist := append(argList, filename)
 		cmd := exec.Command("pdfunite", arglist...)
@@ -212,52 +552,94 @@ func CreatePDFUsingPDFunite(filename string, images []*imageJob) error {
 		fmt.Println("pdfunite", filename, "processed\n", err, "\n", string(out))
 		return err
 	}
-	d, f := path.Split(images[0].filename)
-	_, err := CopyFile(d+"ocr-"+f+".pdf", filename)
+	_, err := CopyFile(images[0].DocumentPDF(), filename)
 	return err
 
 }
 
+var missingTools = map[string]string{
+	"convert":   "convert executable not found. Please check imagemagick installation.",
+	"tesseract": "tesseract executable not found. (Installation packages tesseract-ocr and desired languages)",
+	"hocr2pdf":  "hocr2pdf executable not found. (Installation package exactimage).",
+	"zbarimg":   "zbarimg executable not found. (Installation package zbar-tools).",
+	"jbig2":     "jbig2 executable not found. (Installation package jbig2enc).",
+}
+
 /*
-Check if all dependencies are met
+Check if all dependencies of destinations pipelines are met
 */
 
-func CheckOCRDependencies() (r bool) {
+func CheckOCRDependencies(c *Config) (r bool) {
 	r = false
-	if paramOCR {
-		path, err := exec.LookPath("convert")
-		TRACE.Println("convert", path, err)
-		if err != nil {
-			r = r || true
-			ERROR.Print("convert executable not found. Please check imagemagick installation.")
+	if *c.OCR {
+		needed := make(map[string]bool)
+		for i := range c.Destinations {
+			for _, t := range c.Destinations[i].PipelineTools() {
+				needed[t] = true
+			}
 		}
-		path, err = exec.LookPath("tesseract")
-		TRACE.Println("tesseract", path, err)
-		if err != nil {
-			r = r || true
-			ERROR.Print("tesseract executable not found. (Installation packages tesseract-ocr and desired languages)")
+		for _, tool := range []string{"convert", "tesseract", "hocr2pdf", "zbarimg", "jbig2"} {
+			if !needed[tool] {
+				continue
+			}
+			path, err := exec.LookPath(tool)
+			TRACE.Println(tool, path, err)
+			if err != nil {
+				r = r || true
+				ERROR.Print(missingTools[tool])
+			} else if tool == "tesseract" && CheckTesseractLanguages(c) {
+				r = r || true
+			}
 		}
-		path, err = exec.LookPath("hocr2pdf")
-		TRACE.Println("hocr2pdf", path, err)
+	}
+	switch c.PDFTool {
+	case "", "native":
+		TRACE.Println("PDF pages joined by scantopc")
+	case "pdftk", "pdfunite":
+		path, err := exec.LookPath(c.PDFTool)
+		TRACE.Println(c.PDFTool, path, err)
 		if err != nil {
 			r = r || true
-			ERROR.Print("hocr2pdf executable not found. (Installation package exactimage).")
+			ERROR.Print(c.PDFTool, " executable not found (pdfunite is part of poppler-utils package). Please check installation.")
+		} else {
+			INFO.Println("PDF tool to be used", path)
 		}
-		path1, err1 := exec.LookPath("pdftk")
-		TRACE.Println("pdftk", path1, err1)
-		path2, err2 := exec.LookPath("pdfunite")
-		TRACE.Println("pdfunite", path2, err2)
-		if err1 != nil && err2 != nil {
-			r = r || true
-			ERROR.Print("Neither pdftk or pdfunit (from poppler-utils package) executable are not found. Please check installation.")
+	default:
+		r = r || true
+		ERROR.Print("Unknown PDF tool ", c.PDFTool, " (supported: native, pdftk, pdfunite)")
+	}
+	return r
+}
+
+/*
+Check if traineddata of languages used by destinations are installed
+*/
+
+func CheckTesseractLanguages(c *Config) (r bool) {
+	out, err := exec.Command("tesseract", "--list-langs").CombinedOutput()
+	if err != nil {
+		ERROR.Print("Can't get tesseract languages list: ", err)
+		return true
+	}
+	installed := make(map[string]bool)
+	for _, l := range strings.Split(string(out), "\n") {
+		installed[strings.TrimSpace(l)] = true
+	}
+	for _, d := range c.Destinations {
+		for _, s := range d.Steps {
+			if s.Name == "orient" && s.Option("tool", "native") == "tesseract" && !installed["osd"] {
+				r = true
+				ERROR.Print("tesseract osd data used by destination ", d.Name, " is not installed. (Installation package tesseract-ocr-osd)")
+			}
 		}
-		if paramPFDTool == "" && err2 == nil {
-			paramPFDTool = "pdfunite"
-			INFO.Println("PDF tool to be used", path2)
+		if !d.DoOCR {
+			continue
 		}
-		if paramPFDTool == "" && err1 == nil {
-			paramPFDTool = "pdftk"
-			INFO.Println("PDF tool to be used", path1)
+		for _, l := range d.Languages {
+			if !installed[l] {
+				r = true
+				ERROR.Print("tesseract language ", l, " used by destination ", d.Name, " is not installed. (Installation package tesseract-ocr-", l, ")")
+			}
 		}
 	}
 	return r
@@ -266,16 +648,20 @@ func CheckOCRDependencies() (r bool) {
 // Utility
 func CopyFile(src, dst string) (int64, error) {
 	sf, err := os.Open(src)
-	defer sf.Close()
 	if err != nil {
-		CheckError(src, err)
-		return 0, err
+		return 0, NewDocumentError("CopyFile", src, err)
 	}
+	defer sf.Close()
 	df, err := os.Create(dst)
-	defer df.Close()
 	if err != nil {
-		CheckError(dst, err)
-		return 0, err
+		return 0, NewDocumentError("CopyFile", dst, err)
+	}
+	n, err := io.Copy(df, sf)
+	if cerr := df.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, NewDocumentError("CopyFile", dst, err)
 	}
-	return io.Copy(df, sf)
+	return n, nil
 }
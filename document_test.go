@@ -0,0 +1,94 @@
+// document_test.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_HOCRToText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hocr := filepath.Join(dir, "page.hocr")
+	ioutil.WriteFile(hocr, []byte(testHOCR), 0644)
+	var b bytes.Buffer
+	if err := HOCRToText(hocr, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "Facture n° 12\n" {
+		t.Errorf("unexpected text %q", b.String())
+	}
+}
+
+func Test_CreateJPEG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hocr := filepath.Join(dir, "page.hocr")
+	ioutil.WriteFile(hocr, []byte(testHOCR), 0644)
+	images := []*imageJob{}
+	for _, name := range []string{"page-0000.jpg", "page-0001.jpg"} {
+		writeTestJPEG(t, filepath.Join(dir, name), 10, 10)
+		images = append(images, &imageJob{current: filepath.Join(dir, name), hocr: hocr})
+	}
+	images[1].hocr = ""
+	base := filepath.Join(dir, "scan")
+
+	out := &outputFiles{}
+	err = CreateJPEGFiles(base, images, true, out)
+	if err == nil {
+		err = out.Commit(false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := out.final
+	expected := []string{base + "-001.jpg", base + "-001.txt", base + "-002.jpg"}
+	if len(files) != len(expected) {
+		t.Fatalf("expecting %v, got %v", expected, files)
+	}
+	for i := range expected {
+		if _, err := os.Stat(expected[i]); err != nil || files[i] != expected[i] {
+			t.Errorf("expecting %s, got %s %v", expected[i], files[i], err)
+		}
+	}
+
+	if err = CreateJPEGZip(base+".zip", base, images, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(base + ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	if len(z.File) != 2 || z.File[0].Name != "scan-001.jpg" || z.File[1].Name != "scan-002.jpg" {
+		t.Errorf("unexpected ZIP content %v", z.File)
+	}
+}
+
+func Test_CreateJPEGMissingPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	images := []*imageJob{&imageJob{current: filepath.Join(dir, "missing.jpg")}}
+	out := &outputFiles{}
+	if err = CreateJPEGFiles(filepath.Join(dir, "scan"), images, false, out); err == nil {
+		t.Error("expecting an error for a missing page")
+	}
+	out.Abort()
+	if l, _ := filepath.Glob(filepath.Join(dir, "scan*")); len(l) != 0 {
+		t.Errorf("unexpected files %v", l)
+	}
+}
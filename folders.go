@@ -0,0 +1,163 @@
+// folders.go
+package main
+
+/*
+	Destination folders and permissions
+
+	Missing folders of the document name are created. A name starting with ~
+	is in the home directory of the destination owner, or of the user running
+	the program when the destination has no owner. ~name is in the home
+	directory of the user name.
+
+	Mode and ownership of new files and folders are given by destination:
+
+		[[destination]]
+		name = "Alice"
+		filepattern = "~/Scans/%Y/%Y.%m/%Y%m%d-%H%M%S"
+		owner = "alice:users"     # user, user:group or :group
+		mode = "0640"             # Documents, default 0644
+		dirmode = "0750"          # Folders, default 0777 minus umask
+
+	Changing ownership needs the program to run as root.
+*/
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mode and ownership applied to new files and folders, -1 ids are not changed
+type filePermissions struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode // 0 when not given
+	uid, gid int
+}
+
+// Permissions given by the destination
+func (d *Destination) Permissions() (*filePermissions, error) {
+	p := &filePermissions{fileMode: 0644, uid: -1, gid: -1}
+	if d.Mode != "" {
+		m, err := strconv.ParseUint(d.Mode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, NewDocumentError("Destination.Permissions", "invalid mode "+d.Mode+" for destination "+d.Name)
+		}
+		p.fileMode = os.FileMode(m)
+	}
+	if d.DirMode != "" {
+		m, err := strconv.ParseUint(d.DirMode, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, NewDocumentError("Destination.Permissions", "invalid dirmode "+d.DirMode+" for destination "+d.Name)
+		}
+		p.dirMode = os.FileMode(m)
+	}
+	owner := d.Owner
+	if owner == "" {
+		owner = fileUserGroup
+	}
+	if owner == "" {
+		return p, nil
+	}
+	name, group := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, NewDocumentError("Destination.Permissions", "destination "+d.Name, err)
+		}
+		p.uid, _ = strconv.Atoi(u.Uid)
+		if group == "" {
+			p.gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, NewDocumentError("Destination.Permissions", "destination "+d.Name, err)
+		}
+		p.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return p, nil
+}
+
+// Apply permissions to a new file
+func (p *filePermissions) File(name string) error {
+	if err := os.Chmod(name, p.fileMode); err != nil {
+		return err
+	}
+	return p.chown(name)
+}
+
+func (p *filePermissions) chown(name string) error {
+	if p.uid == -1 && p.gid == -1 {
+		return nil
+	}
+	return os.Chown(name, p.uid, p.gid)
+}
+
+// Replace a leading ~ or ~name by the home directory of the user. ~ is the
+// home of owner when given.
+func ExpandHome(path, owner string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name, rest := path[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	if name == "" {
+		name = strings.SplitN(owner, ":", 2)[0]
+	}
+	var u *user.User
+	var err error
+	if name == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			return home + rest, nil
+		}
+		u, err = user.Current()
+	} else {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return "", NewDocumentError("ExpandHome", path, err)
+	}
+	return u.HomeDir + rest, nil
+}
+
+// Create missing folders, with the mode and the ownership given by permissions
+func MakeFolders(dir string, p *filePermissions) error {
+	dir = filepath.Clean(dir)
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return NewDocumentError("MakeFolders", dir+" is not a folder")
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := MakeFolders(parent, p); err != nil {
+			return err
+		}
+	}
+	mode := filePERM
+	if p.dirMode != 0 {
+		mode = p.dirMode
+	}
+	if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+		return NewDocumentError("MakeFolders", dir, err)
+	}
+	TRACE.Println("Folder", dir, "created")
+	if p.dirMode != 0 {
+		// Not reduced by umask
+		if err := os.Chmod(dir, p.dirMode); err != nil {
+			return NewDocumentError("MakeFolders", dir, err)
+		}
+	}
+	if err := p.chown(dir); err != nil {
+		return NewDocumentError("MakeFolders", dir, err)
+	}
+	return nil
+}
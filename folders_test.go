@@ -0,0 +1,121 @@
+// folders_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func Test_Permissions(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct {
+		d        Destination
+		fileMode os.FileMode
+		dirMode  os.FileMode
+		uid, gid int
+		ok       bool
+	}{
+		{Destination{}, 0644, 0, -1, -1, true},
+		{Destination{Mode: "0640", DirMode: "750"}, 0640, 0750, -1, -1, true},
+		{Destination{Mode: "rw-r-----"}, 0, 0, 0, 0, false},
+		{Destination{Mode: "01777"}, 0, 0, 0, 0, false},
+		{Destination{Owner: u.Username}, 0644, 0, uid, gid, true},
+		{Destination{Owner: ":" + g.Name}, 0644, 0, -1, gid, true},
+		{Destination{Owner: u.Username + ":" + g.Name}, 0644, 0, uid, gid, true},
+		{Destination{Owner: "nosuchuser-scantopc"}, 0, 0, 0, 0, false},
+	} {
+		p, err := c.d.Permissions()
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: unexpected error %v", c.d, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if p.fileMode != c.fileMode || p.dirMode != c.dirMode || p.uid != c.uid || p.gid != c.gid {
+			t.Errorf("%+v: unexpected permissions %+v", c.d, p)
+		}
+	}
+}
+
+func Test_ExpandHome(t *testing.T) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "/home/scanner")
+	root, err := user.Lookup("root")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, c := range []struct{ path, owner, expected string }{
+		{"/tmp/scan", "", "/tmp/scan"},
+		{"~/Documents/scan", "", "/home/scanner/Documents/scan"},
+		{"~", "", "/home/scanner"},
+		{"~root/scan", "", root.HomeDir + "/scan"},
+		{"~/scan", "root:users", root.HomeDir + "/scan"},
+	} {
+		if got, err := ExpandHome(c.path, c.owner); err != nil || got != c.expected {
+			t.Errorf("ExpandHome(%q, %q) = %q, %v, expecting %q", c.path, c.owner, got, err, c.expected)
+		}
+	}
+	if _, err := ExpandHome("~nosuchuser-scantopc/scan", ""); err == nil {
+		t.Errorf("unknown user should give an error")
+	}
+
+	// After switching to another user, ~ is the home of that user
+	for _, v := range []string{"USER", "LOGNAME"} {
+		defer os.Setenv(v, os.Getenv(v))
+	}
+	setUserEnv(&user.User{Username: "scanner", HomeDir: "/var/lib/scanner"})
+	if got, err := ExpandHome("~/scan", ""); err != nil || got != "/var/lib/scanner/scan" {
+		t.Errorf("expecting the home of the switched user, got %q, %v", got, err)
+	}
+}
+
+func Test_MakeFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &filePermissions{fileMode: 0600, dirMode: 0750, uid: -1, gid: -1}
+	folder := filepath.Join(dir, "2014", "2014.01")
+	if err = MakeFolders(folder, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{filepath.Join(dir, "2014"), folder} {
+		info, err := os.Stat(f)
+		if err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+			t.Errorf("unexpected folder %s %v %v", f, info.Mode(), err)
+		}
+	}
+	if info, _ := os.Stat(dir); info.Mode().Perm() == 0750 {
+		t.Errorf("existing folder should not be changed")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	if err = MakeFolders(filepath.Join(dir, "file"), p); err == nil {
+		t.Errorf("a file is not a folder")
+	}
+
+	out := &outputFiles{perm: p}
+	tmp, _ := out.Create(filepath.Join(folder, "scan.pdf"))
+	ioutil.WriteFile(tmp, []byte("document"), 0644)
+	if err = out.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(folder, "scan.pdf")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected document mode %v %v", info, err)
+	}
+}
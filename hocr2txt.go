@@ -27,6 +27,47 @@ func hocr2html(infile string) (err error) {
 	return
 }
 
+// Write the text recognized in an hOCR file, one line of text for each OCR
+// line, paragraphs are separated by an empty line
+func HOCRToText(infile string, out io.Writer) error {
+	defer Un(Trace("HOCRToText", infile))
+	in, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	doc, err := html.Parse(in)
+	if err != nil {
+		return NewDocumentError("HOCRToText", infile, err)
+	}
+	par := false
+	var walk func(n *html.Node) error
+	walk = func(n *html.Node) error {
+		if n.Type == html.ElementNode {
+			class := hocrAttr(n, "class")
+			switch {
+			case hasClass(class, "ocr_par"):
+				if par {
+					if _, err := io.WriteString(out, "\n"); err != nil {
+						return err
+					}
+				}
+				par = true
+			case hasClass(class, "ocr_line", "ocr_textfloat", "ocr_header", "ocr_caption"):
+				_, err := io.WriteString(out, strings.Join(strings.Fields(hocrText(n)), " ")+"\n")
+				return err
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(doc)
+}
+
 var depth = 0
 
 func NodeWrite(n *html.Node, out io.Writer) {
@@ -0,0 +1,273 @@
+// hocrpdf.go
+package main
+
+/*
+	Searchable PDF page writer
+
+	The page image is embedded unchanged as a JPEG (DCTDecode) stream, and
+	each word found by tesseract is written in an invisible text layer at the
+	position given by its hOCR bounding box. Words are written with Courier,
+	its fixed advance gives the horizontal scaling needed to make the word
+	width match the bounding box.
+*/
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/html"
+	"compress/zlib"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A word recognized by OCR, coordinates are in pixels from top left corner
+type hocrWord struct {
+	Text     string
+	X0, Y0   float64
+	X1, Y1   float64
+	Baseline float64 // Y of the baseline
+	Size     float64 // Font size
+}
+
+// Read words from an hOCR file
+func ReadHOCR(filename string) ([]hocrWord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc, err := html.Parse(f)
+	if err != nil {
+		return nil, NewDocumentError("ReadHOCR", filename, err)
+	}
+	words := []hocrWord{}
+	var walk func(n *html.Node, line map[string][]float64)
+	walk = func(n *html.Node, line map[string][]float64) {
+		if n.Type == html.ElementNode {
+			class := hocrAttr(n, "class")
+			title := parseHOCRTitle(hocrAttr(n, "title"))
+			switch {
+			case hasClass(class, "ocr_line", "ocr_textfloat", "ocr_header", "ocr_caption"):
+				line = title
+			case hasClass(class, "ocrx_word"):
+				if w, ok := newHOCRWord(hocrText(n), title, line); ok {
+					words = append(words, w)
+				}
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, line)
+		}
+	}
+	walk(doc, nil)
+	return words, nil
+}
+
+func newHOCRWord(text string, title, line map[string][]float64) (w hocrWord, ok bool) {
+	text = strings.TrimSpace(text)
+	bbox := title["bbox"]
+	if text == "" || len(bbox) != 4 || bbox[2] <= bbox[0] || bbox[3] <= bbox[1] {
+		return w, false
+	}
+	w = hocrWord{Text: text, X0: bbox[0], Y0: bbox[1], X1: bbox[2], Y1: bbox[3]}
+	w.Baseline = w.Y1
+	w.Size = w.Y1 - w.Y0
+	if lb := line["bbox"]; len(lb) == 4 {
+		w.Size = lb[3] - lb[1]
+		if b := line["baseline"]; len(b) == 2 {
+			// Baseline is given relative to the bottom left corner of the line
+			w.Baseline = lb[3] + b[1] + b[0]*(w.X0-lb[0])
+			w.Size = w.Baseline - lb[1]
+		}
+		if xs := line["x_size"]; len(xs) == 1 {
+			w.Size = xs[0]
+		}
+	}
+	if w.Size <= 0 {
+		w.Size = w.Y1 - w.Y0
+	}
+	return w, true
+}
+
+// Parse title properties: "bbox 10 20 30 40; baseline 0.01 -5"
+func parseHOCRTitle(title string) map[string][]float64 {
+	m := make(map[string][]float64)
+	for _, p := range strings.Split(title, ";") {
+		f := strings.Fields(p)
+		if len(f) < 2 {
+			continue
+		}
+		v := []float64{}
+		for _, s := range f[1:] {
+			if x, err := strconv.ParseFloat(s, 64); err == nil {
+				v = append(v, x)
+			}
+		}
+		m[f[0]] = v
+	}
+	return m
+}
+
+func hocrAttr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(class string, names ...string) bool {
+	for _, c := range strings.Fields(class) {
+		if contains(names, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func hocrText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	s := ""
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s += hocrText(c)
+	}
+	return s
+}
+
+// Characters of WinAnsiEncoding outside Latin-1
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+var ligatures = strings.NewReplacer("ﬀ", "ff", "ﬁ", "fi", "ﬂ", "fl", "ﬃ", "ffi", "ﬄ", "ffl", "ﬅ", "st", "ﬆ", "st")
+
+// Encode text with WinAnsiEncoding, unknown characters are replaced by '?'
+func winAnsiEncode(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range ligatures.Replace(s) {
+		switch {
+		case r >= 32 && r < 127, r >= 160 && r <= 255:
+			b = append(b, byte(r))
+		case winAnsi[r] != 0:
+			b = append(b, winAnsi[r])
+		default:
+			b = append(b, '?')
+		}
+	}
+	return string(b)
+}
+
+// Width of Courier glyphs, in text space units
+const courierAdvance = 0.6
+
+// Build the content stream of the page
+func searchablePageContent(words []hocrWord, width, height, dpi float64) []byte {
+	scale := 72 / dpi
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "q\n%s 0 0 %s 0 0 cm\n/Im0 Do\nQ\n", pdfNum(width*scale), pdfNum(height*scale))
+	if len(words) == 0 {
+		return b.Bytes()
+	}
+	b.WriteString("BT\n3 Tr\n")
+	for _, w := range words {
+		text := winAnsiEncode(w.Text)
+		size := w.Size * scale
+		if size <= 0 {
+			continue
+		}
+		// Stretch the word to its bounding box
+		tz := 100 * (w.X1 - w.X0) * scale / (courierAdvance * size * float64(len(text)))
+		fmt.Fprintf(&b, "/F1 %s Tf\n%s Tz\n1 0 0 1 %s %s Tm\n", pdfNum(size), pdfNum(tz), pdfNum(w.X0*scale), pdfNum((height-w.Baseline)*scale))
+		writePDFObject(&b, pdfString(text))
+		b.WriteString(" Tj\n")
+	}
+	b.WriteString("ET\n")
+	return b.Bytes()
+}
+
+func pdfNum(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// Write a PDF page with the JPEG image and the text layer from the hOCR file.
+// When hocr is empty, the page has no text layer.
+func WriteSearchablePDF(jpegFile, hocr string, dpi int, output string) error {
+	return WriteEncodedPDF(jpegFile, hocr, dpi, output, imageEncoding{})
+}
+
+// Write a PDF page, with the image encoded as requested. The page size and
+// the text layer are given by the scanned image.
+func WriteEncodedPDF(jpegFile, hocr string, dpi int, output string, e imageEncoding) error {
+	defer Un(Trace("WriteEncodedPDF", jpegFile, hocr))
+	data, err := ioutil.ReadFile(jpegFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return NewDocumentError("WriteSearchablePDF", jpegFile, err)
+	}
+	if dpi <= 0 {
+		dpi = 300
+	}
+	words := []hocrWord{}
+	if hocr != "" {
+		if words, err = ReadHOCR(hocr); err != nil {
+			return err
+		}
+	}
+
+	img, err := pageImage(data, dpi, e)
+	if err != nil {
+		return NewDocumentError("WriteSearchablePDF", jpegFile, err)
+	}
+	w := NewPDFWriter()
+	imgRef := w.Add(img)
+	font := w.Add(pdfDict{
+		"Type":     pdfName("Font"),
+		"Subtype":  pdfName("Type1"),
+		"BaseFont": pdfName("Courier"),
+		"Encoding": pdfName("WinAnsiEncoding"),
+	})
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(searchablePageContent(words, float64(cfg.Width), float64(cfg.Height), float64(dpi)))
+	zw.Close()
+	content := w.Add(&pdfStream{Dict: pdfDict{"Filter": pdfName("FlateDecode")}, Data: z.Bytes()})
+
+	pagesRef := w.Reserve()
+	scale := 72 / float64(dpi)
+	page := w.Add(pdfDict{
+		"Type":     pdfName("Page"),
+		"Parent":   pagesRef,
+		"MediaBox": pdfArray{0, 0, float64(cfg.Width) * scale, float64(cfg.Height) * scale},
+		"Contents": content,
+		"Resources": pdfDict{
+			"XObject": pdfDict{"Im0": imgRef},
+			"Font":    pdfDict{"F1": font},
+			"ProcSet": pdfArray{pdfName("PDF"), pdfName("Text"), pdfName("ImageB"), pdfName("ImageC")},
+		},
+	})
+	w.Set(pagesRef, pdfDict{"Type": pdfName("Pages"), "Kids": pdfArray{page}, "Count": 1})
+	root := w.Add(pdfDict{"Type": pdfName("Catalog"), "Pages": pagesRef})
+
+	f, err := os.Create(output)
+	if err != nil {
+		return NewDocumentError("WriteSearchablePDF", output, err)
+	}
+	err = w.Write(f, root, pdfRef{})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+// hocrpdf_test.go
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testHOCR = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml">
+<body>
+<div class='ocr_page' id='page_1' title='image "page.jpg"; bbox 0 0 850 1100'>
+ <p class='ocr_par'>
+  <span class='ocr_line' id='line_1_1' title="bbox 100 200 400 240; baseline 0 -10; x_size 30">
+   <span class='ocrx_word' id='word_1_1' title='bbox 100 205 220 230; x_wconf 91'>Facture</span>
+   <span class='ocrx_word' id='word_1_2' title='bbox 240 205 400 230; x_wconf 88'><strong>n°</strong> 12</span>
+   <span class='ocrx_word' id='word_1_3' title='bbox 400 205 410 230; x_wconf 10'> </span>
+  </span>
+ </p>
+</div>
+</body>
+</html>
+`
+
+func writeTestJPEG(t *testing.T, filename string, w, h int) {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	img.SetGray(w/2, h/2, color.Gray{0})
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReadHOCR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "page.hocr")
+	ioutil.WriteFile(filename, []byte(testHOCR), 0644)
+
+	words, err := ReadHOCR(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 2 {
+		t.Fatalf("expecting 2 words, got %v", words)
+	}
+	w := words[0]
+	if w.Text != "Facture" || w.X0 != 100 || w.X1 != 220 || w.Baseline != 230 || w.Size != 30 {
+		t.Errorf("unexpected word %+v", w)
+	}
+	if words[1].Text != "n° 12" {
+		t.Errorf("unexpected word %+v", words[1])
+	}
+}
+
+func Test_WinAnsiEncode(t *testing.T) {
+	for _, c := range []struct{ in, out string }{
+		{"abc", "abc"},
+		{"été", "\xe9t\xe9"},
+		{"5 €", "5 \x80"},
+		{"ﬁn", "fin"},
+		{"日本", "??"},
+	} {
+		if got := winAnsiEncode(c.in); got != c.out {
+			t.Errorf("winAnsiEncode(%q) = %q, expecting %q", c.in, got, c.out)
+		}
+	}
+}
+
+func Test_WriteSearchablePDF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jpg := filepath.Join(dir, "page.jpg")
+	hocr := filepath.Join(dir, "page.hocr")
+	writeTestJPEG(t, jpg, 850, 1100)
+	ioutil.WriteFile(hocr, []byte(testHOCR), 0644)
+
+	for _, c := range []struct {
+		hocr string
+		text bool
+	}{
+		{hocr, true},
+		{"", false},
+	} {
+		output := filepath.Join(dir, "page.pdf")
+		if err := WriteSearchablePDF(jpg, c.hocr, 100, output); err != nil {
+			t.Fatal(err)
+		}
+		r, err := ReadPDFFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages, err := r.Pages()
+		if err != nil || len(pages) != 1 {
+			t.Fatalf("expecting 1 page, got %v %v", pages, err)
+		}
+		page := r.Page(pages[0])
+		box := r.array(page["MediaBox"])
+		if len(box) != 4 || box[2] != 612 || box[3] != 792 {
+			t.Errorf("unexpected MediaBox %v", box)
+		}
+		img, ok := r.Resolve(r.dict(r.dict(page["Resources"])["XObject"])["Im0"]).(*pdfStream)
+		if !ok || img.Dict["ColorSpace"] != pdfName("DeviceGray") || img.Dict["Width"] != 850 {
+			t.Errorf("unexpected image %v", img)
+		}
+		data, err := r.decode(r.Resolve(page["Contents"]).(*pdfStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := string(data)
+		if !strings.Contains(content, "612.00 0 0 792.00 0 0 cm") {
+			t.Errorf("image not scaled to the page: %s", content)
+		}
+		if strings.Contains(content, "(Facture) Tj") != c.text {
+			t.Errorf("unexpected text layer: %s", content)
+		}
+		if c.text {
+			// 100 dpi: word at x=100px, baseline at 230px, 30px high
+			if !strings.Contains(content, "/F1 21.60 Tf") || !strings.Contains(content, "1 0 0 1 72.00 626.40 Tm") {
+				t.Errorf("unexpected word position: %s", content)
+			}
+			if !strings.Contains(content, "(n\xb0 12) Tj") {
+				t.Errorf("unexpected word encoding: %s", content)
+			}
+		}
+	}
+}
@@ -0,0 +1,599 @@
+// imageproc.go
+package main
+
+/*
+	Image preprocessing without external tool
+
+	Steps run in process on the received JPEG, ImageMagick convert is used
+	only when a step has options = { tool = "convert" }.
+
+		deskew     Straighten the page. The skew angle is the one giving the
+		           sharpest horizontal projection profile of dark pixels.
+		           maxangle = 5 (degrees)
+		crop       Remove borders having the color of the top left corner.
+		           fuzz = "10%"
+		normalize  Stretch the contrast, the given percents of darkest and
+		           lightest pixels become black and white.
+		           black = "2%", white = "1%"
+		binarize   Black and white image, with a threshold computed around
+		           each pixel (Sauvola).
+		           window = 51 (pixels), k = 0.2
+		compress   Encode the image again.
+		           quality = 75
+
+	With tool = "convert", deskew accepts fuzz and threshold options as before.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// JPEG quality of intermediate images
+const workQuality = 92
+
+// Apply an in-process operation on the current image
+func (ij *imageJob) process(context string, quality int, op func(img image.Image) image.Image) error {
+	img, err := ReadJPEG(ij.current)
+	if err == nil {
+		err = WriteJPEG(ij.WorkName(), op(img), quality)
+	}
+	ij.report = append(ij.report, toolRun{context, "native " + ij.current, err, ""})
+	if err != nil {
+		ERROR.Println(context, ij.current, err)
+		return err
+	}
+	ij.current = ij.WorkName()
+	return nil
+}
+
+func ReadJPEG(filename string) (image.Image, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, NewDocumentError("ReadJPEG", filename, err)
+	}
+	return img, nil
+}
+
+func WriteJPEG(filename string, img image.Image, quality int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: quality})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Images are processed as gray or RGBA pixels
+func pixels(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.Gray, *image.RGBA:
+		return img
+	}
+	if img.ColorModel() == color.GrayModel {
+		g := image.NewGray(img.Bounds())
+		draw.Draw(g, g.Bounds(), img, img.Bounds().Min, draw.Src)
+		return g
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// Raw pixels of a gray or RGBA image, origin at 0,0
+func rawPixels(img image.Image) (pix []uint8, stride, w, h, ch int) {
+	switch m := pixels(img).(type) {
+	case *image.Gray:
+		m = toOrigin(m).(*image.Gray)
+		return m.Pix, m.Stride, m.Rect.Dx(), m.Rect.Dy(), 1
+	case *image.RGBA:
+		m = toOrigin(m).(*image.RGBA)
+		return m.Pix, m.Stride, m.Rect.Dx(), m.Rect.Dy(), 4
+	}
+	return nil, 0, 0, 0, 0
+}
+
+func toOrigin(img image.Image) image.Image {
+	if img.Bounds().Min == image.ZP {
+		return img
+	}
+	switch m := img.(type) {
+	case *image.Gray:
+		g := image.NewGray(image.Rect(0, 0, m.Rect.Dx(), m.Rect.Dy()))
+		draw.Draw(g, g.Bounds(), m, m.Rect.Min, draw.Src)
+		return g
+	case *image.RGBA:
+		c := image.NewRGBA(image.Rect(0, 0, m.Rect.Dx(), m.Rect.Dy()))
+		draw.Draw(c, c.Bounds(), m, m.Rect.Min, draw.Src)
+		return c
+	}
+	return img
+}
+
+func newPixels(pix []uint8, w, h, ch int) image.Image {
+	if ch == 1 {
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}
+	}
+	return &image.RGBA{Pix: pix, Stride: 4 * w, Rect: image.Rect(0, 0, w, h)}
+}
+
+// Luminance of each pixel
+func luminance(img image.Image) *image.Gray {
+	pix, stride, w, h, ch := rawPixels(img)
+	g := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*stride + x*ch
+			if ch == 1 {
+				g.Pix[y*w+x] = pix[i]
+			} else {
+				g.Pix[y*w+x] = uint8((299*int(pix[i]) + 587*int(pix[i+1]) + 114*int(pix[i+2]) + 500) / 1000)
+			}
+		}
+	}
+	return g
+}
+
+// Parse a percentage like "10%", given as a fraction
+func parsePercent(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || f < 0 || f > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return f / 100, nil
+}
+
+// Threshold separating dark and light pixels (Otsu), dark pixels are at
+// most at the threshold
+func otsuThreshold(g *image.Gray) uint8 {
+	var hist [256]int
+	for _, v := range g.Pix {
+		hist[v]++
+	}
+	total := len(g.Pix)
+	sum := 0
+	for i, n := range hist {
+		sum += i * n
+	}
+	sumB, wB := 0, 0
+	best, threshold := 0.0, 128
+	for t := 0; t < 256; t++ {
+		wB += hist[t]
+		if wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += t * hist[t]
+		mB := float64(sumB) / float64(wB)
+		mF := float64(sum-sumB) / float64(wF)
+		between := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if between > best {
+			best, threshold = between, t
+		}
+	}
+	return uint8(threshold)
+}
+
+// Skew angle of the page in degrees, searched within ±maxAngle. It is the
+// angle given to Rotate to skew a straight page.
+func SkewAngle(img image.Image, maxAngle float64) float64 {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	// A reduced image is enough to find the angle
+	f := 1
+	if w > 1000 {
+		f = w / 1000
+	}
+	threshold := otsuThreshold(g)
+	xs, ys := []float64{}, []float64{}
+	for y := 0; y+f <= h; y += f {
+		for x := 0; x+f <= w; x += f {
+			s := 0
+			for j := 0; j < f; j++ {
+				for i := 0; i < f; i++ {
+					s += int(g.Pix[(y+j)*w+x+i])
+				}
+			}
+			if s/(f*f) <= int(threshold) {
+				xs = append(xs, float64(x/f))
+				ys = append(ys, float64(y/f))
+			}
+		}
+	}
+	if len(xs) == 0 || len(xs) > w*h/f/f/2 {
+		// Blank or mostly dark image
+		return 0
+	}
+	size := (w + h) / f
+	bins := make([]int, 2*size+2)
+	score := func(angle float64) float64 {
+		for i := range bins {
+			bins[i] = 0
+		}
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		for i := range xs {
+			bins[int(ys[i]*cos-xs[i]*sin)+size]++
+		}
+		s := 0.0
+		for i := 1; i < len(bins); i++ {
+			d := float64(bins[i] - bins[i-1])
+			s += d * d
+		}
+		return s
+	}
+	search := func(from, to, step float64) float64 {
+		best, bestScore := 0.0, -1.0
+		for a := from; a <= to+step/2; a += step {
+			if s := score(a); s > bestScore {
+				best, bestScore = a, s
+			}
+		}
+		return best
+	}
+	a := search(-maxAngle, maxAngle, 0.5)
+	return search(a-0.5, a+0.5, 0.05)
+}
+
+// Rotate the image by angle degrees around its center, clockwise with y
+// going down. Uncovered areas are white.
+func Rotate(img image.Image, angle float64) image.Image {
+	pix, stride, w, h, ch := rawPixels(img)
+	out := make([]uint8, w*h*ch)
+	for i := range out {
+		out[i] = 0xff
+	}
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	for y := 0; y < h; y++ {
+		dy := float64(y) - cy
+		for x := 0; x < w; x++ {
+			dx := float64(x) - cx
+			// Source of the pixel
+			sx := cos*dx + sin*dy + cx
+			sy := -sin*dx + cos*dy + cy
+			if sx < -0.5 || sy < -0.5 || sx > float64(w)-0.5 || sy > float64(h)-0.5 {
+				continue
+			}
+			// Pixels beyond the edge take the value of the edge
+			x0, fx := clampPixel(sx, w)
+			y0, fy := clampPixel(sy, h)
+			x1, y1 := imin(x0+1, w-1), imin(y0+1, h-1)
+			for c := 0; c < ch; c++ {
+				v := (1-fy)*((1-fx)*float64(pix[y0*stride+x0*ch+c])+fx*float64(pix[y0*stride+x1*ch+c])) +
+					fy*((1-fx)*float64(pix[y1*stride+x0*ch+c])+fx*float64(pix[y1*stride+x1*ch+c]))
+				out[(y*w+x)*ch+c] = uint8(v + 0.5)
+			}
+		}
+	}
+	return newPixels(out, w, h, ch)
+}
+
+// Pixel before the coordinate, and the weight of the next one, within the
+// n pixels of the line
+func clampPixel(v float64, n int) (int, float64) {
+	i := int(math.Floor(v))
+	switch {
+	case i < 0:
+		return 0, 0
+	case i >= n-1:
+		return n - 1, 0
+	}
+	return i, v - float64(i)
+}
+
+// Straighten the page
+func Deskew(img image.Image, maxAngle float64) (image.Image, float64) {
+	a := SkewAngle(img, maxAngle)
+	if math.Abs(a) < 0.05 {
+		return img, 0
+	}
+	return Rotate(img, -a), a
+}
+
+// Remove borders having the color of the top left corner, within fuzz
+func Trim(img image.Image, fuzz float64) image.Image {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	bg := int(g.Pix[0])
+	tolerance := int(fuzz * 255)
+	// Scanner noise is ignored
+	noise := 2 + w/1000
+	differs := func(v uint8) bool {
+		d := int(v) - bg
+		return d > tolerance || -d > tolerance
+	}
+	rowContent := func(y int) bool {
+		n := 0
+		for x := 0; x < w; x++ {
+			if differs(g.Pix[y*w+x]) {
+				n++
+			}
+		}
+		return n > noise
+	}
+	colContent := func(x, top, bottom int) bool {
+		n := 0
+		for y := top; y < bottom; y++ {
+			if differs(g.Pix[y*w+x]) {
+				n++
+			}
+		}
+		return n > 2+(bottom-top)/1000
+	}
+	top, bottom := 0, h
+	for top < h && !rowContent(top) {
+		top++
+	}
+	for bottom > top && !rowContent(bottom-1) {
+		bottom--
+	}
+	if top >= bottom {
+		// Nothing but borders
+		return img
+	}
+	left, right := 0, w
+	for left < w && !colContent(left, top, bottom) {
+		left++
+	}
+	for right > left && !colContent(right-1, top, bottom) {
+		right--
+	}
+	if left >= right {
+		return img
+	}
+	pix, stride, _, _, ch := rawPixels(img)
+	out := make([]uint8, (right-left)*(bottom-top)*ch)
+	for y := top; y < bottom; y++ {
+		copy(out[(y-top)*(right-left)*ch:], pix[y*stride+left*ch:y*stride+right*ch])
+	}
+	return newPixels(out, right-left, bottom-top, ch)
+}
+
+// Stretch the contrast: black and white fractions of pixels are clipped
+func Normalize(img image.Image, black, white float64) image.Image {
+	g := luminance(img)
+	var hist [256]int
+	for _, v := range g.Pix {
+		hist[v]++
+	}
+	total := len(g.Pix)
+	lo, hi, n := 0, 255, 0
+	for lo < 255 && float64(n+hist[lo]) <= black*float64(total) {
+		n += hist[lo]
+		lo++
+	}
+	n = 0
+	for hi > 0 && float64(n+hist[hi]) <= white*float64(total) {
+		n += hist[hi]
+		hi--
+	}
+	if hi <= lo {
+		return img
+	}
+	var lut [256]uint8
+	for v := range lut {
+		x := (v - lo) * 255 / (hi - lo)
+		if x < 0 {
+			x = 0
+		} else if x > 255 {
+			x = 255
+		}
+		lut[v] = uint8(x)
+	}
+	pix, stride, w, h, ch := rawPixels(img)
+	out := make([]uint8, w*h*ch)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w*ch; x++ {
+			if ch == 4 && x%4 == 3 {
+				out[y*w*ch+x] = pix[y*stride+x]
+				continue
+			}
+			out[y*w*ch+x] = lut[pix[y*stride+x]]
+		}
+	}
+	return newPixels(out, w, h, ch)
+}
+
+// Black and white image, the threshold of each pixel depends on the mean
+// and the deviation around it (Sauvola)
+func Binarize(img image.Image, window int, k float64) *image.Gray {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	r := window / 2
+	// Sums of values and squares by column over the rows of the window, and
+	// their running totals along the row
+	colSum := make([]uint32, w)
+	colSq := make([]uint64, w)
+	sum := make([]uint64, w+1)
+	sq := make([]uint64, w+1)
+	band := func(y int, add bool) {
+		for x, p := range g.Pix[y*w : (y+1)*w] {
+			v := uint32(p)
+			if add {
+				colSum[x] += v
+				colSq[x] += uint64(v * v)
+			} else {
+				colSum[x] -= v
+				colSq[x] -= uint64(v * v)
+			}
+		}
+	}
+	for y := 0; y < r && y < h; y++ {
+		band(y, true)
+	}
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		if y+r < h {
+			band(y+r, true)
+		}
+		if y-r-1 >= 0 {
+			band(y-r-1, false)
+		}
+		for x := 0; x < w; x++ {
+			sum[x+1] = sum[x] + uint64(colSum[x])
+			sq[x+1] = sq[x] + colSq[x]
+		}
+		rows := imin(y+r+1, h) - imax(y-r, 0)
+		for x := 0; x < w; x++ {
+			x0, x1 := imax(x-r, 0), imin(x+r+1, w)
+			n := float64((x1 - x0) * rows)
+			m := float64(sum[x1]-sum[x0]) / n
+			dev := math.Sqrt(math.Max(float64(sq[x1]-sq[x0])/n-m*m, 0))
+			if float64(g.Pix[y*w+x]) > m*(1+k*(dev/128-1)) {
+				out.Pix[y*w+x] = 0xff
+			}
+		}
+	}
+	return out
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Options of the deskew step. fuzz and threshold are given to convert.
+func deskewOptions(s Step) (maxAngle float64, err error) {
+	maxAngle, err = strconv.ParseFloat(s.Option("maxangle", "5"), 64)
+	if err != nil || maxAngle <= 0 || maxAngle > 45 {
+		return 0, NewDocumentError("imageJob.DeskewImage", "invalid maxangle "+s.Option("maxangle", ""))
+	}
+	for _, o := range []string{"fuzz", "threshold"} {
+		if _, err = parsePercent(s.Option(o, "50%")); err != nil {
+			return 0, NewDocumentError("imageJob.DeskewImage", o, err)
+		}
+	}
+	return maxAngle, nil
+}
+
+func (ij *imageJob) DeskewImage(s Step) error {
+	if s.Option("tool", "native") == "convert" {
+		return ij.convert("imageJob.DeskewImage",
+			"-background", "white",
+			"-fuzz", s.Option("fuzz", "75%"),
+			"-deskew", s.Option("threshold", "50%"))
+	}
+	maxAngle, err := deskewOptions(s)
+	if err != nil {
+		return err
+	}
+	return ij.process("imageJob.DeskewImage", workQuality, func(img image.Image) image.Image {
+		img, a := Deskew(img, maxAngle)
+		TRACE.Println("Page", ij.filename, "skew angle", a)
+		return img
+	})
+}
+
+func cropOptions(s Step) (fuzz float64, err error) {
+	if fuzz, err = parsePercent(s.Option("fuzz", "10%")); err != nil {
+		return 0, NewDocumentError("imageJob.CropImage", "fuzz", err)
+	}
+	return fuzz, nil
+}
+
+func (ij *imageJob) CropImage(s Step) error {
+	if s.Option("tool", "native") == "convert" {
+		return ij.convert("imageJob.CropImage",
+			"-fuzz", s.Option("fuzz", "10%"),
+			"-trim", "+repage")
+	}
+	fuzz, err := cropOptions(s)
+	if err != nil {
+		return err
+	}
+	return ij.process("imageJob.CropImage", workQuality, func(img image.Image) image.Image {
+		return Trim(img, fuzz)
+	})
+}
+
+func normalizeOptions(s Step) (black, white float64, err error) {
+	if black, err = parsePercent(s.Option("black", "2%")); err != nil {
+		return 0, 0, NewDocumentError("imageJob.NormalizeImage", "black", err)
+	}
+	if white, err = parsePercent(s.Option("white", "1%")); err != nil {
+		return 0, 0, NewDocumentError("imageJob.NormalizeImage", "white", err)
+	}
+	return black, white, nil
+}
+
+func (ij *imageJob) NormalizeImage(s Step) error {
+	black, white, err := normalizeOptions(s)
+	if err != nil {
+		return err
+	}
+	return ij.process("imageJob.NormalizeImage", workQuality, func(img image.Image) image.Image {
+		return Normalize(img, black, white)
+	})
+}
+
+func binarizeOptions(s Step) (window int, k float64, err error) {
+	window, err = strconv.Atoi(s.Option("window", "51"))
+	if err != nil || window < 3 {
+		return 0, 0, NewDocumentError("imageJob.BinarizeImage", "invalid window "+s.Option("window", ""))
+	}
+	k, err = strconv.ParseFloat(s.Option("k", "0.2"), 64)
+	if err != nil || k < 0 || k > 1 {
+		return 0, 0, NewDocumentError("imageJob.BinarizeImage", "invalid k "+s.Option("k", ""))
+	}
+	return window, k, nil
+}
+
+func (ij *imageJob) BinarizeImage(s Step) error {
+	window, k, err := binarizeOptions(s)
+	if err != nil {
+		return err
+	}
+	return ij.process("imageJob.BinarizeImage", workQuality, func(img image.Image) image.Image {
+		return Binarize(img, window, k)
+	})
+}
+
+func compressOptions(s Step) (quality int, err error) {
+	quality, err = strconv.Atoi(s.Option("quality", "75"))
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, NewDocumentError("imageJob.CompressImage", "invalid quality "+s.Option("quality", ""))
+	}
+	return quality, nil
+}
+
+func (ij *imageJob) CompressImage(s Step) error {
+	if s.Option("tool", "native") == "convert" {
+		return ij.convert("imageJob.CompressImage",
+			"-quality", s.Option("quality", "75"))
+	}
+	quality, err := compressOptions(s)
+	if err != nil {
+		return err
+	}
+	return ij.process("imageJob.CompressImage", quality, func(img image.Image) image.Image {
+		return img
+	})
+}
@@ -0,0 +1,191 @@
+// imageproc_test.go
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// White page with lines of text like dashes
+func testPage(w, h int) *image.Gray {
+	g := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range g.Pix {
+		g.Pix[i] = 0xff
+	}
+	for y := h / 10; y < h-h/10; y += 20 {
+		for x := w / 10; x < w-w/10; x++ {
+			if (x/15)%4 == 3 {
+				continue
+			}
+			for j := 0; j < 6; j++ {
+				g.SetGray(x, y+j, color.Gray{0x10})
+			}
+		}
+	}
+	return g
+}
+
+func Test_SkewAngle(t *testing.T) {
+	page := testPage(800, 1000)
+	if a := SkewAngle(page, 5); math.Abs(a) > 0.1 {
+		t.Errorf("straight page, skew angle %v", a)
+	}
+	for _, angle := range []float64{-3, -1.2, 0.7, 2.5} {
+		skewed := Rotate(page, angle)
+		a := SkewAngle(skewed, 5)
+		if math.Abs(a-angle) > 0.2 {
+			t.Errorf("page rotated by %v, skew angle %v", angle, a)
+			continue
+		}
+		straight, _ := Deskew(skewed, 5)
+		if a := SkewAngle(straight, 5); math.Abs(a) > 0.2 {
+			t.Errorf("page rotated by %v, skew angle %v after deskew", angle, a)
+		}
+	}
+}
+
+func Test_Trim(t *testing.T) {
+	g := image.NewGray(image.Rect(0, 0, 300, 200))
+	for i := range g.Pix {
+		g.Pix[i] = 0x20 // Dark scanner lid
+	}
+	for y := 30; y < 170; y++ {
+		for x := 50; x < 260; x++ {
+			g.SetGray(x, y, color.Gray{0xf0})
+		}
+	}
+	if b := Trim(g, 0.1).Bounds(); b != image.Rect(0, 0, 210, 140) {
+		t.Errorf("unexpected bounds %v", b)
+	}
+	// White margins of a page
+	if b := Trim(testPage(100, 100), 0.1).Bounds(); b != image.Rect(0, 0, 80, 66) {
+		t.Errorf("unexpected bounds %v", b)
+	}
+	// Nothing but borders
+	g = image.NewGray(image.Rect(0, 0, 100, 100))
+	if b := Trim(g, 0.1).Bounds(); b != image.Rect(0, 0, 100, 100) {
+		t.Errorf("unexpected bounds %v", b)
+	}
+}
+
+func Test_Normalize(t *testing.T) {
+	g := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range g.Pix {
+		g.Pix[i] = uint8(60 + i%100)
+	}
+	n := Normalize(g, 0, 0).(*image.Gray)
+	if n.Pix[0] != 0 || n.Pix[99] != 255 {
+		t.Errorf("darkest %v lightest %v", n.Pix[0], n.Pix[99])
+	}
+}
+
+func Test_Binarize(t *testing.T) {
+	g := testPage(200, 200)
+	// Uneven lighting
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			v := int(g.GrayAt(x, y).Y) - x/2
+			if v < 0 {
+				v = 0
+			}
+			g.SetGray(x, y, color.Gray{uint8(v)})
+		}
+	}
+	b := Binarize(g, 51, 0.2)
+	for _, p := range []struct {
+		x, y  int
+		black bool
+	}{
+		{25, 22, true}, {160, 22, true}, {25, 35, false}, {160, 35, false},
+	} {
+		if (b.GrayAt(p.x, p.y).Y == 0) != p.black {
+			t.Errorf("pixel %d,%d is %v", p.x, p.y, b.GrayAt(p.x, p.y).Y)
+		}
+	}
+}
+
+func Test_BinarizeWindow(t *testing.T) {
+	g := testGradient(70, 50)
+	for i := range g.Pix {
+		g.Pix[i] ^= uint8(i * 37)
+	}
+	b := Binarize(g, 15, 0.2)
+	// Threshold computed over the window of each pixel
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 70; x++ {
+			var n, s, q float64
+			for j := imax(y-7, 0); j < imin(y+8, 50); j++ {
+				for i := imax(x-7, 0); i < imin(x+8, 70); i++ {
+					v := float64(g.Pix[j*70+i])
+					n, s, q = n+1, s+v, q+v*v
+				}
+			}
+			m := s / n
+			dev := math.Sqrt(math.Max(q/n-m*m, 0))
+			white := float64(g.Pix[y*70+x]) > m*(1+0.2*(dev/128-1))
+			if white != (b.Pix[y*70+x] == 0xff) {
+				t.Fatalf("pixel %d,%d is %v", x, y, b.Pix[y*70+x])
+			}
+		}
+	}
+}
+
+func Test_RotateEdges(t *testing.T) {
+	g := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range g.Pix {
+		g.Pix[i] = 0x40
+	}
+	r := Rotate(g, 0).(*image.Gray)
+	for i, v := range r.Pix {
+		if v != 0x40 {
+			t.Fatalf("pixel %d,%d is %v", i%40, i/40, v)
+		}
+	}
+}
+
+func Test_parsePercent(t *testing.T) {
+	for _, c := range []struct {
+		s  string
+		f  float64
+		ok bool
+	}{
+		{"10%", 0.1, true}, {" 2.5 ", 0.025, true}, {"120%", 0, false}, {"ten", 0, false},
+	} {
+		f, err := parsePercent(c.s)
+		if (err == nil) != c.ok || math.Abs(f-c.f) > 1e-9 {
+			t.Errorf("parsePercent(%q) = %v, %v", c.s, f, err)
+		}
+	}
+}
+
+func Test_NativeSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ij := &imageJob{filename: filepath.Join(dir, "page-0000.jpg")}
+	ij.current = ij.filename
+	if err = WriteJPEG(ij.filename, Rotate(testPage(400, 500), 2), 90); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Step{{Name: "deskew"}, {Name: "crop"}, {Name: "normalize"}, {Name: "binarize"}, {Name: "compress"}} {
+		if err = pipelineSteps[s.Name].run(ij, s); err != nil {
+			t.Fatal(s.Name, err)
+		}
+	}
+	if ij.current == ij.filename || len(ij.report) != 5 {
+		t.Errorf("current %s, report %v", ij.current, ij.report)
+	}
+	if _, err = ReadJPEG(ij.current); err != nil {
+		t.Error(err)
+	}
+	if err = ij.BinarizeImage(Step{Name: "binarize", Options: map[string]interface{}{"k": "x"}}); err == nil {
+		t.Error("invalid option accepted")
+	}
+}
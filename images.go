@@ -5,26 +5,53 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"time"
 )
 
 type imageJob struct {
-	file     *os.File
-	filename string
-	err      error
-	endChan  chan<- *imageJob
+	file        *os.File
+	filename    string
+	destination *Destination
+	format      string // Document format, .jpg or .pdf
+	current     string // Image produced by the last step
+	hocr        string // hOCR file produced by the ocr step
+	task        *Task
+	err         error
+	step        string     // Step that has failed
+	plain       bool       // Failed page replaced by the scanned image
+	lost        bool       // Page can't be part of the document
+	blank       bool       // Blank page detected
+	ink         float64    // Share of dark pixels, when blank pages are detected
+	rotation    int        // Clockwise rotation applied by the orient step
+	separator   *Separator // Separator sheet, not processed
+	colorMode   string     // Color mode chosen by the colormode step
+	fitted      string     // PDF page reduced to fit the document size
+	report      []toolRun  // Tools launched for the page
+	journal     *Journal
+	batch       time.Time     // Start of the batch, earlier batches are processed first
+	worker      *WorkerStatus // Worker processing the page
+	endChan     chan<- *imageJob
 }
 
 func (ij *imageJob) Write(b []byte) (int, error) {
 	return ij.file.Write(b)
 }
 
-func NewImageJob(filename string, endchan chan<- *imageJob) (ij *imageJob, err error) {
+func NewImageJob(filename string, destination *Destination, format string, endchan chan<- *imageJob) (ij *imageJob, err error) {
 	ij = new(imageJob)
+	ij.task, err = coordinator.Begin("page", filename, path.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
 	ij.file, err = os.Create(filename)
 	ij.filename = filename
+	ij.destination = destination
+	ij.format = format
+	ij.current = filename
 	ij.endChan = endchan
 	if err != nil {
+		coordinator.End(ij.task)
 		return nil, NewDocumentError("NewImageJob", "", err)
 	}
 	TRACE.Println("Opening", filename, "for recieving image")
@@ -35,78 +62,162 @@ func (ij *imageJob) Close() (err error) {
 	TRACE.Println("Closing", ij.filename)
 	ij.err = ij.file.Close()
 	if ij.err == nil {
-		go ij.ImageProcessing()
+		ij.journal.Stage(ij, stageReceived)
+		workers.Submit(ij)
+	} else {
+		ij.lost = true
+		ij.journal.Stage(ij, stageDone)
+		coordinator.End(ij.task)
+		go func() { ij.endChan <- ij }()
 	}
 	return ij.err
 }
 
 func (ij *imageJob) ImageProcessing() {
+	defer coordinator.End(ij.task)
 	TRACE.Println("Processing", ij.filename)
-	err := ij.ImproveImage()
-	if err == nil {
-		err = ij.OCRImage()
+	if ij.destination.Separator != "" {
+		workers.SetStep(ij.worker, "separator")
+		ij.DetectSeparator()
+	}
+	for _, s := range ij.destination.Steps {
+		if ij.separator != nil {
+			// Separator sheets are not part of documents
+			break
+		}
+		if s.Name == "make-pdf" && ij.format != ".pdf" {
+			// Jpeg documents are made of processed images
+			continue
+		}
+		TRACE.Println("Step", s.Name, ij.filename)
+		workers.SetStep(ij.worker, s.Name)
+		if ij.err = pipelineSteps[s.Name].run(ij, s); ij.err != nil {
+			ERROR.Println("Step", s.Name, "has failed for", ij.filename, ij.err)
+			ij.step = s.Name
+			ij.PlainPage()
+			break
+		}
+		ij.journal.Stage(ij, s.Name)
 	}
-	if err == nil {
-		err = ij.CombineHOCRandPDF()
+	if ij.err == nil && ij.separator == nil && ij.destination.DetectsBlank() {
+		workers.SetStep(ij.worker, "blank")
+		ij.DetectBlank()
 	}
+	ij.journal.Stage(ij, stageDone)
 	TRACE.Println("Processed", ij.filename)
-	ij.endChan <- ij
-	TRACE.Println("Processed event sent", ij.filename)
+	select {
+	case ij.endChan <- ij:
+		TRACE.Println("Processed event sent", ij.filename)
+	default:
+		// The batch is still being received, the worker is freed for other pages
+		go func() { ij.endChan <- ij }()
+	}
 }
 
-func (ij *imageJob) ImproveImage() (err error) {
-	dir, file := path.Split(ij.filename)
-	cmd := exec.Command("convert",
-		dir+file,
-		"-background", "white",
-		"-fuzz", "75%",
-		"-deskew", "50%",
-		dir+"ocr-"+file)
+// Replace a failed page by the image received from the scanner, without text
+func (ij *imageJob) PlainPage() {
+	ij.current = ij.filename
+	ij.hocr = ""
+	if ij.format == ".pdf" {
+		if err := WriteEncodedPDF(ij.filename, "", ij.destination.Resolution, ij.PDFName(), ij.Encoding(ij.destination.Compression.Encoding())); err != nil {
+			ERROR.Println("imageJob.PlainPage", ij.filename, err)
+			ij.lost = true
+			return
+		}
+	}
+	ij.plain = true
+	WARNING.Println("Page", ij.filename, "is included as a plain image")
+}
+
+// An external tool launched for a page
+type toolRun struct {
+	Context string
+	Command string
+	Err     error
+	Output  string
+}
+
+// Run an external tool, its output is kept for the batch report
+func (ij *imageJob) run(context string, cmd *exec.Cmd) error {
 	out, err := TimeOutCombinedOutput(time.Minute, cmd)
+	ij.report = append(ij.report, toolRun{context, strings.Join(cmd.Args, " "), err, string(out)})
 	if err != nil {
-		ERROR.Println("imageJob.ImproveImage", "Command "+cmd.Path+" has failed", err)
+		ERROR.Println(context, "Command "+cmd.Path+" has failed", err)
 		fmt.Println("Command output", string(out))
 	}
 	return err
 }
 
-func (ij *imageJob) OCRImage() (err error) {
+// Name of the image produced by processing steps
+func (ij *imageJob) WorkName() string {
 	dir, file := path.Split(ij.filename)
-	//TODO: tesseract language should be a parameter
-	cmd := exec.Command("tesseract",
-		dir+"ocr-"+file,
-		dir+"ocr-"+file,
-		"-l", "fra",
-		"hocr")
-	out, err := TimeOutCombinedOutput(time.Minute, cmd)
+	return dir + "ocr-" + file
+}
+
+// Name of the PDF page produced by the make-pdf step
+func (ij *imageJob) PDFName() string {
+	return ij.WorkName() + ".pdf"
+}
+
+// PDF page used in the document
+func (ij *imageJob) DocumentPDF() string {
+	if ij.fitted != "" {
+		return ij.fitted
+	}
+	return ij.PDFName()
+}
+
+// Apply convert with given options on the current image
+func (ij *imageJob) convert(context string, options ...string) (err error) {
+	args := append([]string{ij.current}, options...)
+	cmd := exec.Command("convert", append(args, ij.WorkName())...)
+	if err = ij.run(context, cmd); err != nil {
+		return err
+	}
+	ij.current = ij.WorkName()
+	return nil
+}
+
+func (ij *imageJob) OCRImage(s Step) (err error) {
+	args := []string{ij.current, ij.WorkName()}
+	args = append(args, ij.destination.TesseractOptions()...)
+	cmd := exec.Command("tesseract", append(args, "hocr")...)
+	if err = ij.run("imageJob.OCRImage", cmd); err != nil {
+		return err
+	}
+	// tesseract 3.02 gives .html files, later versions give .hocr
+	ij.hocr = ij.WorkName() + ".hocr"
+	if _, err = os.Stat(ij.hocr); err != nil {
+		ij.hocr = ij.WorkName() + ".html"
+	}
+	return nil
+}
+
+// Produce the PDF page, with a text layer when the page has been OCRed.
+// hocr2pdf is used when given by the tool option.
+func (ij *imageJob) MakePDF(s Step) (err error) {
+	if ij.hocr != "" && s.Option("tool", "native") == "hocr2pdf" {
+		return ij.CombineHOCRandPDF()
+	}
+	err = WriteEncodedPDF(ij.current, ij.hocr, ij.destination.Resolution, ij.PDFName(), ij.Encoding(ij.destination.Compression.Encoding()))
 	if err != nil {
-		ERROR.Println("imageJob.OCRImage", "Command "+cmd.Path+" has failed", err)
-		fmt.Println("Command output", string(out))
+		ERROR.Println("imageJob.MakePDF", err)
 	}
 	return err
 }
 
 func (ij *imageJob) CombineHOCRandPDF() (err error) {
-	dir, file := path.Split(ij.filename)
 	cmd := exec.Command("hocr2pdf",
-		"--input", dir+"ocr-"+file,
-		"--output", dir+"ocr-"+file+".pdf")
-	in, err := os.Open(dir + "ocr-" + file + ".html")
+		"--input", ij.current,
+		"--output", ij.PDFName())
+	in, err := os.Open(ij.hocr)
 	if err != nil {
 		err = NewDocumentError("imageJob.CombineHOCRandPDF", "Reading hocr file", err)
 		return
 	}
 	defer in.Close()
 	cmd.Stdin = in
-	var out []byte
-	if err == nil {
-		out, err = TimeOutCombinedOutput(time.Minute, cmd)
-	}
-	if err != nil {
-		ERROR.Println("imageJob.CombineHOCRandPDF", "Command "+cmd.Path+" has failed", err)
-		fmt.Println("Command output", string(out))
-	}
-	return err
+	return ij.run("imageJob.CombineHOCRandPDF", cmd)
 }
 
 // Launch a command and kill it when timeout
@@ -0,0 +1,371 @@
+// journal.go
+package main
+
+/*
+	Batch journal
+
+	Each batch is received in its own folder of the spool directory, with a
+	journal.json file giving the batch settings, the scan time, the page list
+	and the stage reached by each page. The journal is written again at each
+	change, it survives a crash or a power cut:
+
+		spool = "/var/spool/scantopc"   # Batch folders, default is the temporary folder
+		spoolmaxage = "168h"            # Orphaned folders older than this are removed
+
+	At startup, unfinished batches are processed again: processed pages are
+	kept as they are, others go through the pipeline from the scanned image.
+	Pages that were being received are dropped.
+	Batch folders without journal, or of finished batches, are removed when
+	they are older than spoolmaxage. Other folders of the spool directory, like
+	the quarantine, are left as they are.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/simulot/hpdevices"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const journalName = "journal.json"
+
+// Prefix of batch folders in the spool directory
+const batchFolderPrefix = "scantopc-batch-"
+
+// Stages of a page, the name of the last step done is used while processing
+const (
+	stageReceiving = "receiving"
+	stageReceived  = "received"
+	stageDone      = "done"
+)
+
+type JournalPage struct {
+	File      string // Names are relative to the batch folder
+	Stage     string
+	Current   string     `json:",omitempty"`
+	HOCR      string     `json:",omitempty"`
+	Step      string     `json:",omitempty"` // Step that has failed
+	Error     string     `json:",omitempty"`
+	Plain     bool       `json:",omitempty"`
+	Lost      bool       `json:",omitempty"`
+	Blank     bool       `json:",omitempty"`
+	Ink       float64    `json:",omitempty"`
+	Rotation  int        `json:",omitempty"`
+	Separator *Separator `json:",omitempty"`
+	ColorMode string     `json:",omitempty"`
+}
+
+type Journal struct {
+	lock        sync.Mutex
+	filename    string
+	Name        string // Destination name on the printer
+	FilePattern string
+	Verso       bool
+	Doctype     string
+	Format      string
+	When        time.Time
+	Destination Destination
+	Closed      bool     // All pages are received
+	Done        bool     // The document is written
+	Output      []string `json:",omitempty"` // Temporary files created in destination folders
+	Pages       []*JournalPage
+}
+
+// Folder where batches are received
+func (c *Config) SpoolFolder() string {
+	if c.Spool != "" {
+		return c.Spool
+	}
+	return os.TempDir()
+}
+
+// Create the journal of a new batch
+func NewJournal(bm *OCRBatchImageManager) *Journal {
+	j := &Journal{
+		filename:    filepath.Join(bm.tempfolder, journalName),
+		Name:        bm.settings.Name,
+		Verso:       bm.settings.Verso,
+		Doctype:     bm.doctype,
+		Format:      bm.format,
+		When:        bm.when,
+		Destination: *bm.destination,
+		Pages:       []*JournalPage{},
+	}
+	if bm.settings.FilePattern != nil {
+		j.FilePattern = *bm.settings.FilePattern
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.save()
+	return j
+}
+
+func ReadJournal(folder string) (*Journal, error) {
+	filename := filepath.Join(folder, journalName)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{filename: filename}
+	if err = json.Unmarshal(b, j); err != nil {
+		return nil, NewDocumentError("ReadJournal", filename, err)
+	}
+	return j, nil
+}
+
+// Write the journal under a temporary name, then rename it. A crash leaves
+// the previous version.
+func (j *Journal) save() {
+	b, err := json.MarshalIndent(j, "", "\t")
+	if err == nil {
+		err = writeFileSync(j.filename+".tmp", b)
+	}
+	if err == nil {
+		err = os.Rename(j.filename+".tmp", j.filename)
+	}
+	if err != nil {
+		ERROR.Println("Journal.save", j.filename, err)
+	}
+}
+
+func writeFileSync(filename string, b []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *Journal) page(filename string) *JournalPage {
+	file := filepath.Base(filename)
+	for _, p := range j.Pages {
+		if p.File == file {
+			return p
+		}
+	}
+	p := &JournalPage{File: file}
+	j.Pages = append(j.Pages, p)
+	return p
+}
+
+// A page is being received
+func (j *Journal) AddPage(filename string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.page(filename).Stage = stageReceiving
+	j.save()
+}
+
+// Record the stage reached by a page
+func (j *Journal) Stage(ij *imageJob, stage string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	p := j.page(ij.filename)
+	p.Stage = stage
+	p.Current = filepath.Base(ij.current)
+	p.HOCR = ""
+	if ij.hocr != "" {
+		p.HOCR = filepath.Base(ij.hocr)
+	}
+	p.Plain, p.Lost = ij.plain, ij.lost
+	p.Blank, p.Ink = ij.blank, ij.ink
+	p.Rotation, p.Separator = ij.rotation, ij.separator
+	p.ColorMode = ij.colorMode
+	if ij.err != nil {
+		p.Step, p.Error = ij.step, ij.err.Error()
+	}
+	j.save()
+}
+
+// A temporary file is about to be created in a destination folder
+func (j *Journal) AddOutput(filename string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Output = append(j.Output, filename)
+	j.save()
+}
+
+// The temporary file has not been created
+func (j *Journal) DropOutput(filename string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for i, f := range j.Output {
+		if f == filename {
+			j.Output = append(j.Output[:i], j.Output[i+1:]...)
+			break
+		}
+	}
+	j.save()
+}
+
+// Remove temporary files left in destination folders by an interrupted run
+func (j *Journal) RemoveOutput() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, f := range j.Output {
+		if err := os.Remove(f); err == nil {
+			INFO.Println("Temporary file", f, "left by the previous run is removed")
+		} else if !os.IsNotExist(err) {
+			ERROR.Println("Journal.RemoveOutput", err)
+		}
+	}
+	j.Output = nil
+	j.save()
+}
+
+// All pages are received
+func (j *Journal) Close() {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Closed = true
+	j.save()
+}
+
+// The document is written
+func (j *Journal) Finish() {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Done = true
+	j.save()
+}
+
+// Finish batches interrupted by the previous run, and remove orphaned
+// folders of the spool directory
+func ResumeBatches(c *Config) {
+	defer Un(Trace("ResumeBatches", c.SpoolFolder()))
+	spool := c.SpoolFolder()
+	infos, err := ioutil.ReadDir(spool)
+	if err != nil {
+		ERROR.Println("ResumeBatches", err)
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), "scantopc") {
+			continue
+		}
+		folder := filepath.Join(spool, info.Name())
+		j, err := ReadJournal(folder)
+		if err == nil && !j.Done {
+			if err = ResumeBatch(folder, j); err != nil {
+				ERROR.Println("ResumeBatches", folder, err)
+			}
+			continue
+		}
+		if err != nil && !strings.HasPrefix(info.Name(), batchFolderPrefix) {
+			// Not a batch folder
+			continue
+		}
+		if time.Since(info.ModTime()) > c.SpoolMaxAge.Duration {
+			INFO.Println("Removing orphaned spool folder", folder)
+			if err = os.RemoveAll(folder); err != nil {
+				ERROR.Println("ResumeBatches", err)
+			}
+		}
+	}
+}
+
+// Process again pages of an unfinished batch, and write its document
+func ResumeBatch(folder string, j *Journal) (err error) {
+	INFO.Println("Resuming batch", j.Name, j.When.Format("2006-01-02 15:04:05"), "from", folder)
+	bm := new(OCRBatchImageManager)
+	pattern := j.FilePattern
+	bm.settings = &hpdevices.DestinationSettings{Name: j.Name, FilePattern: &pattern, Verso: j.Verso}
+	bm.config = CurrentConfig()
+	bm.destination = &j.Destination
+	bm.doctype = j.Doctype
+	bm.format = j.Format
+	bm.when = j.When
+	bm.tempfolder = folder
+	bm.journal = j
+	bm.task, err = coordinator.Begin("batch", j.Name+" "+j.When.Format("2006-01-02 15:04:05"), folder)
+	if err != nil {
+		return err
+	}
+	bm.imageJobChan = make(chan *imageJob)
+	bm.finalized = make(chan bool)
+	j.RemoveOutput()
+
+	pages := []*JournalPage{}
+	for _, p := range j.Pages {
+		if p.Stage == stageReceiving {
+			WARNING.Println("Page", p.File, "was not completely received, it's dropped")
+			continue
+		}
+		pages = append(pages, p)
+	}
+	j.lock.Lock()
+	j.Pages = pages
+	j.Closed = true
+	j.save()
+	j.lock.Unlock()
+
+	jobs := []*imageJob{}
+	for _, p := range pages {
+		ij := &imageJob{
+			filename:    filepath.Join(folder, p.File),
+			destination: bm.destination,
+			format:      bm.format,
+			endChan:     bm.imageJobChan,
+			journal:     j,
+			batch:       j.When,
+		}
+		ij.current = ij.filename
+		if p.Stage == stageDone {
+			ij.current = filepath.Join(folder, p.Current)
+			if p.HOCR != "" {
+				ij.hocr = filepath.Join(folder, p.HOCR)
+			}
+			ij.plain, ij.lost, ij.step = p.Plain, p.Lost, p.Step
+			ij.blank, ij.ink = p.Blank, p.Ink
+			ij.rotation, ij.separator = p.Rotation, p.Separator
+			ij.colorMode = p.ColorMode
+			if p.Error != "" {
+				ij.err = errors.New(p.Error)
+			}
+		} else if ij.task, err = coordinator.Begin("page", ij.filename, folder); err != nil {
+			coordinator.End(bm.task)
+			return err
+		}
+		jobs = append(jobs, ij)
+	}
+	bm.imagelist = jobs
+	go bm.FinalizeDocumentBatch()
+	for i, ij := range jobs {
+		if pages[i].Stage == stageDone {
+			go func(ij *imageJob) { ij.endChan <- ij }(ij)
+		} else {
+			workers.Submit(ij)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// journal_test.go
+package main
+
+import (
+	"github.com/simulot/hpdevices"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := "/home/user/%Y"
+	bm := &OCRBatchImageManager{
+		tempfolder:  dir,
+		settings:    &hpdevices.DestinationSettings{Name: "OCR", FilePattern: &pattern},
+		destination: &Destination{Name: "OCR", DoOCR: true, Steps: DefaultPipeline(true)},
+		doctype:     "PDF",
+		format:      ".pdf",
+		when:        time.Date(2014, 1, 4, 19, 8, 31, 0, time.UTC),
+	}
+	j := NewJournal(bm)
+	ij := &imageJob{filename: filepath.Join(dir, "page-0000.jpg")}
+	j.AddPage(ij.filename)
+	j.AddPage(filepath.Join(dir, "page-0001.jpg"))
+	ij.current = filepath.Join(dir, "ocr-page-0000.jpg")
+	ij.hocr = ij.current + ".hocr"
+	j.Stage(ij, "ocr")
+	j.Close()
+
+	r, err := ReadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "OCR" || r.FilePattern != pattern || r.Format != ".pdf" || !r.When.Equal(bm.when) || !r.Closed || r.Done {
+		t.Errorf("unexpected journal %+v", r)
+	}
+	if len(r.Destination.Steps) != 3 || !r.Destination.DoOCR {
+		t.Errorf("unexpected destination %+v", r.Destination)
+	}
+	if len(r.Pages) != 2 {
+		t.Fatalf("expecting 2 pages, got %v", r.Pages)
+	}
+	p := r.Pages[0]
+	if p.File != "page-0000.jpg" || p.Stage != "ocr" || p.Current != "ocr-page-0000.jpg" || p.HOCR != "ocr-page-0000.jpg.hocr" {
+		t.Errorf("unexpected page %+v", p)
+	}
+	if r.Pages[1].Stage != stageReceiving {
+		t.Errorf("unexpected page %+v", r.Pages[1])
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalName+".tmp")); err == nil {
+		t.Errorf("temporary journal left")
+	}
+}
+
+func Test_ResumeBatches(t *testing.T) {
+	spool, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+	c := &Config{Spool: spool, SpoolMaxAge: duration{time.Hour}}
+	SetCurrentConfig(c)
+	old := time.Now().Add(-2 * time.Hour)
+
+	// Orphaned folders
+	for _, name := range []string{"scantopc-batch-old", "scantopc-batch-recent", "scantopc-done", "scantopc-quarantine", "other"} {
+		os.Mkdir(filepath.Join(spool, name), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(spool, "scantopc-done", journalName), []byte(`{"Done":true}`), 0644)
+	for _, name := range []string{"scantopc-batch-old", "scantopc-done", "scantopc-quarantine", "other"} {
+		os.Chtimes(filepath.Join(spool, name), old, old)
+	}
+
+	// Unfinished Jpeg batch: a processed page, a received one and a partial one
+	folder := filepath.Join(spool, "scantopc-unfinished")
+	os.Mkdir(folder, 0755)
+	pattern := filepath.Join(spool, "scan")
+	bm := &OCRBatchImageManager{
+		tempfolder:  folder,
+		settings:    &hpdevices.DestinationSettings{Name: "Photo", FilePattern: &pattern},
+		destination: &Destination{Name: "Photo", Steps: DefaultPipeline(false)[1:]},
+		doctype:     "Jpeg",
+		format:      ".jpg",
+		when:        time.Now(),
+	}
+	j := NewJournal(bm)
+	for i, stage := range []string{stageDone, stageReceived, stageReceiving} {
+		ij := &imageJob{filename: filepath.Join(folder, JPEGPageName("page", i)+".jpg")}
+		ij.current = ij.filename
+		writeTestJPEG(t, ij.filename, 10, 10)
+		j.AddPage(ij.filename)
+		j.Stage(ij, stage)
+	}
+	os.Chtimes(folder, old, old)
+
+	ResumeBatches(c)
+	for _, name := range []string{"scantopc-batch-old", "scantopc-done"} {
+		if _, err := os.Stat(filepath.Join(spool, name)); err == nil {
+			t.Errorf("%s should be removed", name)
+		}
+	}
+	for _, name := range []string{"scantopc-batch-recent", "scantopc-quarantine", "other", "scantopc-unfinished"} {
+		if _, err := os.Stat(filepath.Join(spool, name)); err != nil {
+			t.Errorf("%s should be kept", name)
+		}
+	}
+
+	for end := time.Now().Add(5 * time.Second); len(coordinator.Running()) > 0 && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, name := range []string{"scan-001.jpg", "scan-002.jpg"} {
+		if _, err := os.Stat(filepath.Join(spool, name)); err != nil {
+			t.Errorf("page %s not written", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(spool, "scan-003.jpg")); err == nil {
+		t.Errorf("partial page should be dropped")
+	}
+	if r, err := ReadJournal(folder); err != nil || !r.Done || len(r.Pages) != 2 {
+		t.Errorf("unexpected journal %+v %v", r, err)
+	}
+}
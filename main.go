@@ -44,29 +44,57 @@ var (
 	paramDoubleSide   bool
 	paramOCR          bool
 	paramPFDTool      string
+	paramConfigFile   string
+	paramService      bool
+	paramPIDFile      string
+	paramUser         string
+	paramStopTimeout  time.Duration
 )
 
 func main() {
+	if ParseCommand(os.Args[1:]) == "stop" {
+		os.Exit(StopCommand())
+	}
 	GetParameters()
-	MainLoop()
+	HandleSignals()
+	if paramService {
+		if err := StartService(); err != nil {
+			ERROR.Println(err)
+			os.Exit(1)
+		}
+	}
+	ResumeBatches(CurrentConfig())
+	go MainLoop()
+	SdNotify("READY=1")
+	sig := <-terminate
+	INFO.Println("Signal", sig, "received, stopping")
+	SdNotify("STOPPING=1")
+	Shutdown()
+	if paramService {
+		StopService()
+	}
 	INFO.Println(os.Args[0], "stopped")
-
 }
 
 func init() {
 	flag.BoolVar(&paramModeTrace, "trace", false, "Enable traces")
 	flag.StringVar(&paramComputerName, "name", hostname(), "Name of the computer visible on the printer (default: $hostname)")
-	flag.StringVar(&paramPrinterURL, "printer", "", "Printer URL like http://1.2.3.4:8080, when omitted, the device is searched on the network")
+	flag.StringVar(&paramPrinterURL, "printer", "", "Printer URLs like http://1.2.3.4:8080, comma separated, when omitted, the device is searched on the network")
 	flag.StringVar(&paramFolderPatern, "destination", "", "Folder where images are strored (see help for tokens)")
 	flag.StringVar(&paramFolderPatern, "d", "", "shorthand for -destination")
-	flag.StringVar(&paramPFDTool, "pdftool", "", "precise which tool to be used when joining pages (supported: pdftk,pdfunite)")
+	flag.StringVar(&paramPFDTool, "pdftool", "", "precise which tool to be used when joining pages (supported: native,pdftk,pdfunite)")
 	flag.BoolVar(&paramOCR, "ocr", true, "enable/disable OCR functionality")
+	flag.StringVar(&paramConfigFile, "config", "", "Configuration file (TOML) listing destinations")
+	flag.BoolVar(&paramService, "service", false, "Run as a service: write pid file, switch user, notify systemd")
+	flag.StringVar(&paramPIDFile, "pidfile", "/var/run/scantopc/scantopc.pid", "PID file used in service mode and by the stop command")
+	flag.StringVar(&paramUser, "user", "", "User running the service")
+	flag.DurationVar(&paramStopTimeout, "stoptimeout", 3*time.Minute, "Time given to the running instance to stop")
 	//paramModeTrace = true
 
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "\nUsage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nUsage of %s [stop]:\n", os.Args[0])
 	flag.PrintDefaults()
 	fmt.Println("\nExemple:")
 	fmt.Println("\t", os.Args[0], "-destination ~/Documents/%Y/%Y.%m/%Y.%m.%d-%H.%M.%S")
@@ -76,84 +104,55 @@ func usage() {
 	os.Exit(1)
 }
 
+// Parse flags and give the command, flags can follow the command:
+// scantopc stop -pidfile /run/scantopc/scantopc.pid
+func ParseCommand(args []string) string {
+	flag.CommandLine.Parse(args)
+	command := flag.Arg(0)
+	if command != "" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	return command
+}
+
 func banner() {
 	INFO.Println(os.Args[0], "version", VERSION, "started")
 }
 
 func GetParameters() {
 	flag.Parse()
+	flagsSet = SetFlags()
+	c, err := LoadConfig(paramConfigFile)
+	if err == nil {
+		c.MergeFlags(flagsSet)
+		paramModeTrace = c.Trace
+	}
 	InitLogFiles()
 	hpdevices.InitLogger(TRACE, INFO, WARNING, ERROR)
 	banner()
+	if err != nil {
+		ERROR.Println(err)
+		usage()
+	}
 
-	if paramComputerName == "" {
-		paramComputerName, _ = os.Hostname()
+	if c.ComputerName == "" {
+		c.ComputerName, _ = os.Hostname()
 	}
-	if paramFolderPatern == "" {
-		WARNING.Println("No destination given, assuming: -destination=./%Y%m%d-%H%M%S")
-		paramFolderPatern = "./%Y%m%d-%H%M%S"
-	} else {
-		// Test the pattern to detect issues immediatly
-		s, err := ExpandString(paramFolderPatern, time.Now())
-		if err != nil {
-			ERROR.Println(err)
-			usage()
-		}
-		TRACE.Println("Save to ", s)
+	// Test the patterns to detect issues immediatly
+	if err = c.Check(); err != nil {
+		ERROR.Println(err)
+		usage()
 	}
-	if CheckOCRDependencies() {
+	if CheckOCRDependencies(c) {
 		ERROR.Println("One or many depencies are not found. Please check your setup")
 		usage()
 	}
+	SetCurrentConfig(c)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 func MainLoop() {
 	defer Un(Trace("MainLoop"))
-
-	for {
-		var (
-			Scanner *hpdevices.HPDevice
-			err     error
-		)
-
-		if paramPrinterURL == "" {
-			TRACE.Println("Searching printer on the network")
-			Scanner, err = hpdevices.LocalizeDevice()
-		} else {
-			TRACE.Println("Connection to the printer")
-			Scanner, err = hpdevices.NewHPDevice(paramPrinterURL)
-		}
-		if err != nil {
-			ERROR.Println(err)
-		}
-		time.Sleep(time.Second * 5)
-		if err == nil {
-			INFO.Println("Found device at", Scanner.URL)
-			d := []hpdevices.DestinationSettings{
-				hpdevices.DestinationSettings{
-					Name:        "OCR",
-					FilePattern: &paramFolderPatern,
-					DoOCR:       true,
-					Verso:       false,
-					Resolution:  300,
-					ColorSpace:  "Gray",
-				},
-				hpdevices.DestinationSettings{
-					Name:        "OCR (Verso)",
-					FilePattern: &paramFolderPatern,
-					DoOCR:       true,
-					Verso:       true,
-					Resolution:  300,
-					ColorSpace:  "Gray",
-				},
-			}
-
-			_, err := hpdevices.NewScanToPC(Scanner, NewOCRBatchImageManager, paramComputerName, d)
-			if err != nil {
-				ERROR.Println(err)
-			}
-		}
-	}
+	ServeDevices()
 }
@@ -21,10 +21,23 @@ func TokensUsage() {
 	%S  Second (2 digits):    20
 	%p  AM / PM:              PM
 	%e	Extension			  jpg or pdf
+	%i  Document index:       01 (batch split by separator sheets)
+	%t  Document title:       given by a separator sheet
 	`)
 }
 
+// Values of document tokens
+type nameValues struct {
+	index int    // Document of the batch, from 1
+	title string // Title given by the separator sheet
+}
+
 func ExpandString(layout string, t time.Time) (value string, err error) {
+	return ExpandName(layout, t, nameValues{})
+}
+
+// Expand time and document tokens
+func ExpandName(layout string, t time.Time, v nameValues) (value string, err error) {
 	value = ""
 	err = nil
 	for i := 0; i < len(layout); {
@@ -66,6 +79,13 @@ func ExpandString(layout string, t time.Time) (value string, err error) {
 				value += t.Format("05")
 			case 'p': // am / pm
 				value += t.Format("pm")
+			case 'i': // Document index
+				if v.index == 0 {
+					v.index = 1
+				}
+				value += fmt.Sprintf("%02d", v.index)
+			case 't': // Document title
+				value += v.title
 			default:
 				err = errors.New(fmt.Sprintf("Unknown token %%%c", c))
 				break
@@ -0,0 +1,225 @@
+// orient.go
+package main
+
+/*
+	Page orientation
+
+	The orient step turns pages fed upside down or sideways, so they are
+	upright for the OCR and in the document. It must come before ocr:
+
+		[[destination.step]]
+		name = "orient"
+		options = { tool = "tesseract" }   # or native (default)
+
+	The native detector finds the direction of text lines from the projection
+	profiles of dark pixels, then the top of the lines from ascenders, more
+	frequent than descenders in latin scripts. tesseract uses its OSD mode,
+	it needs the osd traineddata.
+
+	The rotation applied to each page is logged and given in the Rotations
+	entry of the PDF information, as page:degrees clockwise.
+*/
+
+import (
+	"fmt"
+	"image"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimum ratio between the two candidate orientations to turn a page
+const orientationConfidence = 1.5
+
+// Rotate the image clockwise by 0, 90, 180 or 270 degrees
+func RotateRight(img image.Image, degrees int) image.Image {
+	degrees = ((degrees % 360) + 360) % 360
+	if degrees == 0 {
+		return img
+	}
+	pix, stride, w, h, ch := rawPixels(img)
+	ow, oh := w, h
+	if degrees != 180 {
+		ow, oh = h, w
+	}
+	out := make([]uint8, ow*oh*ch)
+	for y := 0; y < oh; y++ {
+		for x := 0; x < ow; x++ {
+			var sx, sy int
+			switch degrees {
+			case 90:
+				sx, sy = y, h-1-x
+			case 180:
+				sx, sy = w-1-x, h-1-y
+			default:
+				sx, sy = w-1-y, x
+			}
+			copy(out[(y*ow+x)*ch:(y*ow+x+1)*ch], pix[sy*stride+sx*ch:])
+		}
+	}
+	return newPixels(out, ow, oh, ch)
+}
+
+// Clockwise rotation making the page upright, and the confidence of the
+// decision, the ratio between the best and the worst candidates.
+func Orientation(img image.Image) (int, float64) {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	f := 1
+	if w > 1000 {
+		f = w / 1000
+	}
+	threshold := otsuThreshold(g)
+	rw, rh := w/f, h/f
+	rows, cols := make([]int, rh), make([]int, rw)
+	for y := 0; y < rh; y++ {
+		for x := 0; x < rw; x++ {
+			s := 0
+			for j := 0; j < f; j++ {
+				for i := 0; i < f; i++ {
+					s += int(g.Pix[(y*f+j)*w+x*f+i])
+				}
+			}
+			if s/(f*f) <= int(threshold) {
+				rows[y]++
+				cols[x]++
+			}
+		}
+	}
+	// Text lines make the sharpest profile
+	horizontal := profileScore(rows) >= profileScore(cols)
+	profile := cols
+	if horizontal {
+		profile = rows
+	}
+	before, after := ascenders(profile)
+	ratio := func(a, b int) float64 {
+		if b == 0 {
+			b = 1
+		}
+		return float64(a) / float64(b)
+	}
+	switch {
+	case horizontal && before >= after:
+		return 0, ratio(before, after)
+	case horizontal:
+		return 180, ratio(after, before)
+	case before >= after:
+		// Top of the text on the left
+		return 90, ratio(before, after)
+	default:
+		return 270, ratio(after, before)
+	}
+}
+
+func profileScore(p []int) float64 {
+	s := 0.0
+	for i := 1; i < len(p); i++ {
+		d := float64(p[i] - p[i-1])
+		s += d * d
+	}
+	return s
+}
+
+// Dark pixels before and after the core of each text line of the profile
+func ascenders(p []int) (before, after int) {
+	peak := 0
+	for _, v := range p {
+		if v > peak {
+			peak = v
+		}
+	}
+	if peak == 0 {
+		return 0, 0
+	}
+	for i := 0; i < len(p); {
+		if p[i] <= peak/20 {
+			i++
+			continue
+		}
+		// Line from i to j
+		j, m := i, 0
+		for ; j < len(p) && p[j] > peak/20; j++ {
+			if p[j] > m {
+				m = p[j]
+			}
+		}
+		// Core rows, as dense as half of the densest one
+		a, b := i, j-1
+		for p[a] < m/2 {
+			a++
+		}
+		for p[b] < m/2 {
+			b--
+		}
+		for k := i; k < a; k++ {
+			before += p[k]
+		}
+		for k := b + 1; k < j; k++ {
+			after += p[k]
+		}
+		i = j
+	}
+	return before, after
+}
+
+// Rotation given by tesseract OSD output
+func parseOSD(out string) (int, error) {
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, "Rotate:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(l, "Rotate:")))
+		}
+	}
+	return 0, fmt.Errorf("no rotation in tesseract output")
+}
+
+func (ij *imageJob) OrientImage(s Step) error {
+	rotation := 0
+	if s.Option("tool", "native") == "tesseract" {
+		cmd := exec.Command("tesseract", ij.current, "stdout", "--psm", "0")
+		out, err := TimeOutCombinedOutput(time.Minute, cmd)
+		ij.report = append(ij.report, toolRun{"imageJob.OrientImage", strings.Join(cmd.Args, " "), err, string(out)})
+		if err == nil {
+			rotation, err = parseOSD(string(out))
+		}
+		if err != nil {
+			// Too few characters for instance, the page is kept as it is
+			TRACE.Println("tesseract output", string(out))
+			WARNING.Println("Orientation of page", ij.filename, "can't be detected", err)
+			return nil
+		}
+	} else {
+		img, err := ReadJPEG(ij.current)
+		if err != nil {
+			return err
+		}
+		r, confidence := Orientation(img)
+		TRACE.Println("Page", ij.filename, "orientation", r, "confidence", confidence)
+		if confidence >= orientationConfidence {
+			rotation = r
+		}
+	}
+	if rotation%360 == 0 {
+		return nil
+	}
+	INFO.Println("Page", ij.filename, "rotated by", rotation, "degrees")
+	err := ij.process("imageJob.OrientImage", workQuality, func(img image.Image) image.Image {
+		return RotateRight(img, rotation)
+	})
+	if err == nil {
+		ij.rotation = rotation
+	}
+	return err
+}
+
+// Rotations of document pages, as page:degrees
+func RotationList(pages []*imageJob) string {
+	l := []string{}
+	for i, ij := range pages {
+		if ij.rotation != 0 {
+			l = append(l, fmt.Sprint(i+1, ":", ij.rotation))
+		}
+	}
+	return strings.Join(l, ",")
+}
@@ -0,0 +1,91 @@
+// orient_test.go
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Upright page of latin like text: letters have ascenders more often than
+// descenders
+func testTextPage(w, h int) *image.Gray {
+	g := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range g.Pix {
+		g.Pix[i] = 0xff
+	}
+	fill := func(x0, y0, x1, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				g.SetGray(x, y, color.Gray{0x20})
+			}
+		}
+	}
+	n := 0
+	for y := h / 10; y < h-h/10-30; y += 32 {
+		// Letters of lines are not aligned
+		for x := w/10 + y%7; x < w-w/10; x += 8 + n%3 {
+			n++
+			if n%7 == 0 {
+				// Space between words
+				continue
+			}
+			fill(x, y+8, x+6, y+16)
+			if n%5 < 2 {
+				fill(x, y, x+2, y+8)
+			}
+			if n%6 == 0 {
+				fill(x, y+16, x+2, y+22)
+			}
+		}
+	}
+	return g
+}
+
+func Test_RotateRight(t *testing.T) {
+	g := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(g.Pix, []uint8{1, 2, 3, 4, 5, 6})
+	for _, c := range []struct {
+		degrees int
+		w, h    int
+		pix     []uint8
+	}{
+		{90, 2, 3, []uint8{4, 1, 5, 2, 6, 3}},
+		{180, 3, 2, []uint8{6, 5, 4, 3, 2, 1}},
+		{270, 2, 3, []uint8{3, 6, 2, 5, 1, 4}},
+		{-90, 2, 3, []uint8{3, 6, 2, 5, 1, 4}},
+	} {
+		r := RotateRight(g, c.degrees).(*image.Gray)
+		if r.Rect.Dx() != c.w || r.Rect.Dy() != c.h || string(r.Pix) != string(c.pix) {
+			t.Errorf("rotation %d: got %v %v", c.degrees, r.Rect, r.Pix)
+		}
+	}
+}
+
+func Test_Orientation(t *testing.T) {
+	page := testTextPage(600, 800)
+	for _, r := range []int{0, 90, 180, 270} {
+		rotation, confidence := Orientation(RotateRight(page, r))
+		if expected := (360 - r) % 360; rotation != expected || confidence < orientationConfidence {
+			t.Errorf("page rotated by %d: rotation %d, confidence %v", r, rotation, confidence)
+		}
+	}
+}
+
+func Test_parseOSD(t *testing.T) {
+	out := "Page number: 0\nOrientation in degrees: 270\nRotate: 90\nOrientation confidence: 5.21\n"
+	if r, err := parseOSD(out); err != nil || r != 90 {
+		t.Errorf("got %d %v", r, err)
+	}
+	if _, err := parseOSD("Too few characters. Skipping this page\n"); err == nil {
+		t.Errorf("error expected")
+	}
+}
+
+func Test_RotationList(t *testing.T) {
+	pages := testPages("p", 3)
+	pages[1].rotation = 180
+	if l := RotationList(pages); l != "2:180" {
+		t.Errorf("unexpected list %s", l)
+	}
+}
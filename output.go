@@ -0,0 +1,135 @@
+// output.go
+package main
+
+/*
+	Document output
+
+	Files of a document are written under temporary names in their target
+	folder, then renamed to their final names when all of them are complete.
+	A document being written is never visible under its final name, and a
+	document written again, like a recto replaced by the recto verso
+	document, is replaced in one step. Temporary names are recorded in the
+	batch journal before their creation, files left by a crash are removed
+	when the batch is resumed.
+
+	When a file of a new document already exists, the destination collision
+	policy gives what to do:
+
+		collision = "counter"     # Add -1, -2... to the name (default)
+		collision = "overwrite"   # Replace the existing file
+		collision = "fail"        # Keep the existing file, the batch is quarantined
+*/
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Collision policies
+const (
+	collisionCounter   = "counter"
+	collisionOverwrite = "overwrite"
+	collisionFail      = "fail"
+)
+
+// Collision policy of the destination, counter when not given
+func (d *Destination) CollisionPolicy() string {
+	if d.Collision == "" {
+		return collisionCounter
+	}
+	return d.Collision
+}
+
+// Files of a document being written
+type outputFiles struct {
+	temp    []string
+	final   []string
+	perm    *filePermissions // Applied before renaming when given
+	journal *Journal         // Records temporary names when given
+}
+
+// Give the temporary name to be used for a file of the document
+func (o *outputFiles) Create(final string) (string, error) {
+	for try := 0; try < 100; try++ {
+		name := filepath.Join(filepath.Dir(final), "."+filepath.Base(final)+"."+strconv.Itoa(int(rand.Int31())))
+		o.journal.AddOutput(name)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			// The file belongs to another document
+			o.journal.DropOutput(name)
+			continue
+		}
+		if err != nil {
+			return "", NewDocumentError("outputFiles.Create", final, err)
+		}
+		f.Close()
+		o.temp = append(o.temp, name)
+		o.final = append(o.final, final)
+		return name, nil
+	}
+	return "", NewDocumentError("outputFiles.Create", final+": no temporary name available")
+}
+
+// Rename files to their final names. Without overwrite, nothing is left
+// when a file exists, and the error is given as it is to be checked with
+// os.IsExist.
+func (o *outputFiles) Commit(overwrite bool) error {
+	if o.perm != nil {
+		for i, f := range o.temp {
+			if err := o.perm.File(f); err != nil {
+				return NewDocumentError("outputFiles.Commit", o.final[i], err)
+			}
+		}
+	}
+	for i := range o.temp {
+		var err error
+		if overwrite {
+			err = os.Rename(o.temp[i], o.final[i])
+		} else {
+			err = renameNoReplace(o.temp[i], o.final[i])
+		}
+		if err == nil {
+			continue
+		}
+		if !overwrite {
+			// Files already renamed are removed
+			for _, f := range o.final[:i] {
+				os.Remove(f)
+			}
+		}
+		o.temp = o.temp[i:]
+		if os.IsExist(err) {
+			return err
+		}
+		return NewDocumentError("outputFiles.Commit", o.final[i], err)
+	}
+	o.temp = nil
+	return nil
+}
+
+// Rename a file unless the new name exists. A hard link is used to check and
+// rename in one step.
+func renameNoReplace(oldname, newname string) error {
+	err := os.Link(oldname, newname)
+	if err == nil {
+		return os.Remove(oldname)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	// Hard links are not supported by the file system
+	if _, e := os.Stat(newname); e == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	return os.Rename(oldname, newname)
+}
+
+// Remove files not yet renamed
+func (o *outputFiles) Abort() {
+	for _, f := range o.temp {
+		os.Remove(f)
+	}
+	o.temp = nil
+}
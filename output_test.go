@@ -0,0 +1,180 @@
+// output_test.go
+package main
+
+import (
+	"github.com/simulot/hpdevices"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_OutputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	final := filepath.Join(dir, "scan.pdf")
+	ioutil.WriteFile(final, []byte("recto"), 0644)
+
+	out := &outputFiles{}
+	tmp, err := out.Create(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmp) != dir || tmp == final {
+		t.Errorf("unexpected temporary name %s", tmp)
+	}
+	ioutil.WriteFile(tmp, []byte("recto verso"), 0644)
+	if b, _ := ioutil.ReadFile(final); string(b) != "recto" {
+		t.Errorf("document replaced before commit")
+	}
+	if err = out.Commit(false); !os.IsExist(err) {
+		t.Errorf("existing file should not be replaced, got %v", err)
+	}
+	if err = out.Commit(true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(final); string(b) != "recto verso" {
+		t.Errorf("document not replaced")
+	}
+
+	out = &outputFiles{}
+	out.Create(filepath.Join(dir, "other.pdf"))
+	out.Abort()
+	if l, _ := ioutil.ReadDir(dir); len(l) != 1 {
+		t.Errorf("temporary files left: %v", l)
+	}
+}
+
+func Test_CombinePagesReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "scan")
+	bm := &OCRBatchImageManager{
+		settings:    &hpdevices.DestinationSettings{Name: "Photo", FilePattern: &pattern},
+		destination: &Destination{Zip: true},
+		config:      &Config{},
+		format:      ".jpg",
+		when:        time.Now(),
+	}
+	images := []*imageJob{}
+	for i := 0; i < 2; i++ {
+		ij := &imageJob{filename: filepath.Join(dir, JPEGPageName("page", i)+".jpg")}
+		ij.current = ij.filename
+		writeTestJPEG(t, ij.filename, 10, 10)
+		images = append(images, ij)
+	}
+
+	// Recto written as a ZIP file, then as page files
+	if err = bm.CombinePages(images[:1]); err != nil {
+		t.Fatal(err)
+	}
+	bm.destination.Zip = false
+	if err = bm.CombinePages(images); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pattern + ".zip"); err == nil {
+		t.Errorf("previous document not erased")
+	}
+	for _, name := range []string{"scan-001.jpg", "scan-002.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(bm.files) != 2 {
+		t.Errorf("unexpected files %v", bm.files)
+	}
+	if l, _ := ioutil.ReadDir(dir); len(l) != 4 {
+		t.Errorf("unexpected files in folder: %d", len(l))
+	}
+}
+
+func Test_CollisionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "scan")
+	ij := &imageJob{filename: filepath.Join(dir, "page-0000.jpg")}
+	ij.current = ij.filename
+	writeTestJPEG(t, ij.filename, 10, 10)
+	ioutil.WriteFile(pattern+".zip", []byte("previous"), 0644)
+
+	for _, c := range []struct {
+		policy   string
+		expected string // empty on failure
+	}{
+		{collisionCounter, pattern + "-1.zip"},
+		{collisionCounter, pattern + "-2.zip"},
+		{"", pattern + "-3.zip"}, // Counter when not given
+		{collisionFail, ""},
+		{collisionOverwrite, pattern + ".zip"},
+	} {
+		bm := &OCRBatchImageManager{
+			settings:    &hpdevices.DestinationSettings{Name: "Photo", FilePattern: &pattern},
+			destination: &Destination{Zip: true, Collision: c.policy},
+			config:      &Config{},
+			format:      ".jpg",
+			when:        time.Now(),
+		}
+		err := bm.CombinePages([]*imageJob{ij})
+		if c.expected == "" {
+			if !os.IsExist(err) {
+				t.Errorf("%s: expecting an error, got %v", c.policy, err)
+			}
+			continue
+		}
+		if err != nil || bm.filename != c.expected {
+			t.Errorf("%s: expecting %s, got %s %v", c.policy, c.expected, bm.filename, err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(pattern + ".zip"); string(b) == "previous" {
+		t.Errorf("document should be overwritten")
+	}
+	if l, _ := ioutil.ReadDir(dir); len(l) != 5 {
+		t.Errorf("unexpected files in folder: %d", len(l))
+	}
+}
+
+func Test_OutputFilesLeft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "batch")
+	os.Mkdir(folder, 0755)
+	pattern := filepath.Join(dir, "scan")
+	bm := &OCRBatchImageManager{
+		tempfolder:  folder,
+		settings:    &hpdevices.DestinationSettings{Name: "Photo", FilePattern: &pattern},
+		destination: &Destination{Name: "Photo"},
+		when:        time.Now(),
+	}
+	j := NewJournal(bm)
+
+	// Crash while the document is written
+	out := &outputFiles{journal: j}
+	tmp, err := out.Create(filepath.Join(dir, "scan.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadJournal(folder)
+	if err != nil || len(r.Output) != 1 || r.Output[0] != tmp {
+		t.Fatalf("temporary file not recorded: %v, %v", r, err)
+	}
+	r.RemoveOutput()
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary file %s left", tmp)
+	}
+	if r, _ = ReadJournal(folder); len(r.Output) != 0 {
+		t.Errorf("unexpected temporary files %v", r.Output)
+	}
+}
@@ -0,0 +1,952 @@
+// pdf.go
+package main
+
+/*
+	Minimal PDF object model
+
+	Reads PDF files produced by hocr2pdf, convert, or any PDF 1.x writer,
+	including cross reference streams and object streams, and writes PDF files
+	with a classic cross reference table.
+	Streams are kept encoded, only cross reference and object streams are decoded.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+type pdfObject interface{}
+
+type pdfName string
+
+type pdfString string
+
+type pdfArray []pdfObject
+
+type pdfDict map[pdfName]pdfObject
+
+type pdfRef struct {
+	Num, Gen int
+}
+
+type pdfStream struct {
+	Dict pdfDict
+	Data []byte // Encoded data
+}
+
+func pdfError(context string, v ...interface{}) error {
+	return NewDocumentError(context, fmt.Sprint(v...))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Lexer and parser
+
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if isPDFSpace(c) {
+			p.pos++
+		} else if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		} else {
+			return
+		}
+	}
+}
+
+// Read a regular token: keyword or number
+func (p *pdfParser) token() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// Check if the next token is the keyword, and consume it
+func (p *pdfParser) keyword(k string) bool {
+	save := p.pos
+	if p.token() == k {
+		return true
+	}
+	p.pos = save
+	return false
+}
+
+func (p *pdfParser) parseObject() (pdfObject, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, pdfError("pdfParser", "unexpected end of data")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		return p.parseName(), nil
+	case c == '(':
+		return p.parseLiteralString()
+	case c == '<':
+		if p.pos+1 < len(p.data) && p.data[p.pos+1] == '<' {
+			return p.parseDict()
+		}
+		return p.parseHexString()
+	case c == '[':
+		p.pos++
+		a := pdfArray{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return a, nil
+			}
+			o, err := p.parseObject()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, o)
+		}
+	case isPDFDelimiter(c):
+		return nil, pdfError("pdfParser", "unexpected character '", string(c), "' at ", p.pos)
+	}
+
+	start := p.pos
+	t := p.token()
+	switch t {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if i, err := strconv.Atoi(t); err == nil {
+		// Could be a reference: num gen R
+		save := p.pos
+		if g, err := strconv.Atoi(p.token()); err == nil && p.keyword("R") {
+			return pdfRef{i, g}, nil
+		}
+		p.pos = save
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(t, 64); err == nil {
+		return f, nil
+	}
+	return nil, pdfError("pdfParser", "unexpected token '", t, "' at ", start)
+}
+
+func (p *pdfParser) parseName() pdfName {
+	p.pos++
+	b := []byte{}
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		c := p.data[p.pos]
+		if c == '#' && p.pos+2 < len(p.data) {
+			if v, err := strconv.ParseUint(string(p.data[p.pos+1:p.pos+3]), 16, 8); err == nil {
+				b = append(b, byte(v))
+				p.pos += 3
+				continue
+			}
+		}
+		b = append(b, c)
+		p.pos++
+	}
+	return pdfName(b)
+}
+
+func (p *pdfParser) parseLiteralString() (pdfObject, error) {
+	p.pos++
+	b := []byte{}
+	depth := 0
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return pdfString(b), nil
+			}
+			depth--
+		case '\\':
+			if p.pos >= len(p.data) {
+				break
+			}
+			c = p.data[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+						v = v*8 + int(p.data[p.pos]-'0')
+						p.pos++
+					}
+					c = byte(v)
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return nil, pdfError("pdfParser", "unterminated string")
+}
+
+func (p *pdfParser) parseHexString() (pdfObject, error) {
+	p.pos++
+	hex := []byte{}
+	for p.pos < len(p.data) && p.data[p.pos] != '>' {
+		if !isPDFSpace(p.data[p.pos]) {
+			hex = append(hex, p.data[p.pos])
+		}
+		p.pos++
+	}
+	p.pos++
+	if len(hex)%2 == 1 {
+		hex = append(hex, '0')
+	}
+	b := make([]byte, len(hex)/2)
+	for i := range b {
+		v, err := strconv.ParseUint(string(hex[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return nil, pdfError("pdfParser", "bad hex string")
+		}
+		b[i] = byte(v)
+	}
+	return pdfString(b), nil
+}
+
+func (p *pdfParser) parseDict() (pdfObject, error) {
+	p.pos += 2
+	d := pdfDict{}
+	for {
+		p.skipSpace()
+		if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+			p.pos += 2
+			return d, nil
+		}
+		if p.pos >= len(p.data) || p.data[p.pos] != '/' {
+			return nil, pdfError("pdfParser", "dictionary key expected at ", p.pos)
+		}
+		k := p.parseName()
+		v, err := p.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		d[k] = v
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Reader
+
+type xrefEntry struct {
+	offset     int // Offset in file, or index in object stream
+	stream     int // Object stream number, when compressed
+	compressed bool
+}
+
+type pdfReader struct {
+	data    []byte
+	version string
+	xref    map[int]xrefEntry
+	trailer pdfDict
+	cache   map[int]pdfObject
+	loading map[int]bool
+}
+
+func ReadPDFFile(filename string) (*pdfReader, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewPDFReader(data)
+	if err != nil {
+		return nil, NewDocumentError("ReadPDFFile", filename, err)
+	}
+	return r, nil
+}
+
+func NewPDFReader(data []byte) (*pdfReader, error) {
+	r := &pdfReader{
+		data:    data,
+		version: "1.4",
+		xref:    make(map[int]xrefEntry),
+		cache:   make(map[int]pdfObject),
+		loading: make(map[int]bool),
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, pdfError("NewPDFReader", "not a PDF file")
+	}
+	if len(data) > 8 {
+		r.version = string(data[5:8])
+	}
+	err := r.readXref()
+	if err == nil {
+		_, err = r.Root()
+	}
+	if err != nil {
+		// Damaged cross reference, objects are searched in the whole file
+		TRACE.Println("NewPDFReader", err, ", reconstructing cross reference")
+		if err = r.reconstructXref(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *pdfReader) readXref() error {
+	tail := r.data
+	if len(tail) > 2048 {
+		tail = tail[len(tail)-2048:]
+	}
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return pdfError("pdfReader.readXref", "startxref not found")
+	}
+	p := &pdfParser{data: tail, pos: i + len("startxref")}
+	offset, err := strconv.Atoi(p.token())
+	if err != nil {
+		return pdfError("pdfReader.readXref", "bad startxref")
+	}
+	seen := make(map[int]bool)
+	for offset > 0 && !seen[offset] {
+		seen[offset] = true
+		trailer, err := r.readXrefSection(offset)
+		if err != nil {
+			return err
+		}
+		if r.trailer == nil {
+			r.trailer = trailer
+		}
+		if s, ok := trailer["XRefStm"].(int); ok {
+			if _, err = r.readXrefSection(s); err != nil {
+				return err
+			}
+		}
+		offset, _ = trailer["Prev"].(int)
+	}
+	return nil
+}
+
+// Read a cross reference section. Entries already known are not replaced.
+func (r *pdfReader) readXrefSection(offset int) (pdfDict, error) {
+	if offset >= len(r.data) {
+		return nil, pdfError("pdfReader.readXrefSection", "bad offset ", offset)
+	}
+	p := &pdfParser{data: r.data, pos: offset}
+	if !p.keyword("xref") {
+		return r.readXrefStream(offset)
+	}
+	for {
+		if p.keyword("trailer") {
+			o, err := p.parseObject()
+			if err != nil {
+				return nil, err
+			}
+			d, ok := o.(pdfDict)
+			if !ok {
+				return nil, pdfError("pdfReader.readXrefSection", "bad trailer")
+			}
+			return d, nil
+		}
+		start, err1 := strconv.Atoi(p.token())
+		count, err2 := strconv.Atoi(p.token())
+		if err1 != nil || err2 != nil {
+			return nil, pdfError("pdfReader.readXrefSection", "bad xref subsection at ", p.pos)
+		}
+		for i := 0; i < count; i++ {
+			off, err1 := strconv.Atoi(p.token())
+			_, err2 := strconv.Atoi(p.token())
+			kind := p.token()
+			if err1 != nil || err2 != nil {
+				return nil, pdfError("pdfReader.readXrefSection", "bad xref entry at ", p.pos)
+			}
+			if _, known := r.xref[start+i]; !known && kind == "n" {
+				r.xref[start+i] = xrefEntry{offset: off}
+			}
+		}
+	}
+}
+
+func (r *pdfReader) readXrefStream(offset int) (pdfDict, error) {
+	_, o, err := r.parseIndirect(offset)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := o.(*pdfStream)
+	if !ok || s.Dict["Type"] != pdfName("XRef") {
+		return nil, pdfError("pdfReader.readXrefStream", "no cross reference at ", offset)
+	}
+	data, err := r.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	w := []int{}
+	for _, v := range r.array(s.Dict["W"]) {
+		n, _ := v.(int)
+		w = append(w, n)
+	}
+	if len(w) != 3 {
+		return nil, pdfError("pdfReader.readXrefStream", "bad W")
+	}
+	index := []int{}
+	for _, v := range r.array(s.Dict["Index"]) {
+		n, _ := v.(int)
+		index = append(index, n)
+	}
+	if len(index) == 0 {
+		size, _ := s.Dict["Size"].(int)
+		index = []int{0, size}
+	}
+	field := func(b []byte) int {
+		v := 0
+		for _, c := range b {
+			v = v<<8 | int(c)
+		}
+		return v
+	}
+	pos := 0
+	entry := w[0] + w[1] + w[2]
+	for i := 0; i+1 < len(index); i += 2 {
+		for n := index[i]; n < index[i]+index[i+1]; n++ {
+			if pos+entry > len(data) {
+				return nil, pdfError("pdfReader.readXrefStream", "truncated stream")
+			}
+			kind := 1
+			if w[0] > 0 {
+				kind = field(data[pos : pos+w[0]])
+			}
+			f2 := field(data[pos+w[0] : pos+w[0]+w[1]])
+			f3 := field(data[pos+w[0]+w[1] : pos+entry])
+			pos += entry
+			if _, known := r.xref[n]; known {
+				continue
+			}
+			switch kind {
+			case 1:
+				r.xref[n] = xrefEntry{offset: f2}
+			case 2:
+				r.xref[n] = xrefEntry{stream: f2, offset: f3, compressed: true}
+			}
+		}
+	}
+	return s.Dict, nil
+}
+
+var pdfObjRegexp = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+func (r *pdfReader) reconstructXref() error {
+	r.xref = make(map[int]xrefEntry)
+	r.cache = make(map[int]pdfObject)
+	for _, m := range pdfObjRegexp.FindAllSubmatchIndex(r.data, -1) {
+		if m[0] > 0 && !isPDFSpace(r.data[m[0]-1]) {
+			continue
+		}
+		n, _ := strconv.Atoi(string(r.data[m[2]:m[3]]))
+		r.xref[n] = xrefEntry{offset: m[0]}
+	}
+	// Compressed objects of object streams
+	for n := range r.xref {
+		if s, ok := r.Object(n).(*pdfStream); ok && s.Dict["Type"] == pdfName("ObjStm") {
+			if nums, _, err := r.objectStream(n); err == nil {
+				for i, num := range nums {
+					if _, known := r.xref[num]; !known {
+						r.xref[num] = xrefEntry{stream: n, offset: i, compressed: true}
+					}
+				}
+			}
+		}
+	}
+	// Last trailer, or the catalog
+	if i := bytes.LastIndex(r.data, []byte("trailer")); i >= 0 {
+		p := &pdfParser{data: r.data, pos: i + len("trailer")}
+		if o, err := p.parseObject(); err == nil {
+			r.trailer, _ = o.(pdfDict)
+		}
+	}
+	if _, err := r.Root(); err != nil {
+		for n := range r.xref {
+			if d, ok := r.Object(n).(pdfDict); ok && d["Type"] == pdfName("Catalog") {
+				r.trailer = pdfDict{"Root": pdfRef{n, 0}}
+				break
+			}
+		}
+	}
+	_, err := r.Root()
+	return err
+}
+
+// Parse the indirect object at offset
+func (r *pdfReader) parseIndirect(offset int) (int, pdfObject, error) {
+	p := &pdfParser{data: r.data, pos: offset}
+	num, err1 := strconv.Atoi(p.token())
+	_, err2 := strconv.Atoi(p.token())
+	if err1 != nil || err2 != nil || !p.keyword("obj") {
+		return 0, nil, pdfError("pdfReader.parseIndirect", "no object at ", offset)
+	}
+	o, err := p.parseObject()
+	if err != nil {
+		return 0, nil, err
+	}
+	d, ok := o.(pdfDict)
+	if !ok || !p.keyword("stream") {
+		return num, o, nil
+	}
+	// Stream data starts after EOL following the keyword
+	if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		p.pos++
+	}
+	start := p.pos
+	length := -1
+	switch l := d["Length"].(type) {
+	case int:
+		length = l
+	case pdfRef:
+		if l.Num != num && !r.loading[l.Num] {
+			length, _ = r.Resolve(l).(int)
+		}
+	}
+	end := start + length
+	if length < 0 || end > len(r.data) || !bytes.HasPrefix(bytes.TrimLeft(r.data[end:], "\r\n "), []byte("endstream")) {
+		// Wrong length, search the end of stream
+		i := bytes.Index(r.data[start:], []byte("endstream"))
+		if i < 0 {
+			return 0, nil, pdfError("pdfReader.parseIndirect", "endstream not found for object ", num)
+		}
+		end = start + i
+		for end > start && (r.data[end-1] == '\n' || r.data[end-1] == '\r') {
+			end--
+		}
+	}
+	return num, &pdfStream{Dict: d, Data: r.data[start:end]}, nil
+}
+
+// Give the object by its number
+func (r *pdfReader) Object(num int) pdfObject {
+	if o, ok := r.cache[num]; ok {
+		return o
+	}
+	e, ok := r.xref[num]
+	if !ok || r.loading[num] {
+		return nil
+	}
+	r.loading[num] = true
+	defer delete(r.loading, num)
+	var o pdfObject
+	if e.compressed {
+		_, objects, err := r.objectStream(e.stream)
+		if err == nil && e.offset < len(objects) {
+			o = objects[e.offset]
+		}
+	} else {
+		n, obj, err := r.parseIndirect(e.offset)
+		if err == nil && n == num {
+			o = obj
+		}
+	}
+	r.cache[num] = o
+	return o
+}
+
+// Decode an object stream, give numbers and objects it contains
+func (r *pdfReader) objectStream(num int) ([]int, []pdfObject, error) {
+	s, ok := r.Object(num).(*pdfStream)
+	if !ok {
+		return nil, nil, pdfError("pdfReader.objectStream", "object stream ", num, " not found")
+	}
+	data, err := r.decode(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, _ := r.Resolve(s.Dict["N"]).(int)
+	first, _ := r.Resolve(s.Dict["First"]).(int)
+	p := &pdfParser{data: data}
+	nums := make([]int, n)
+	offsets := make([]int, n)
+	for i := 0; i < n; i++ {
+		nums[i], _ = strconv.Atoi(p.token())
+		offsets[i], _ = strconv.Atoi(p.token())
+	}
+	objects := make([]pdfObject, n)
+	for i := 0; i < n; i++ {
+		p.pos = first + offsets[i]
+		if p.pos < len(data) {
+			objects[i], _ = p.parseObject()
+		}
+	}
+	return nums, objects, nil
+}
+
+// Follow references
+func (r *pdfReader) Resolve(o pdfObject) pdfObject {
+	for i := 0; i < 32; i++ {
+		ref, ok := o.(pdfRef)
+		if !ok {
+			return o
+		}
+		o = r.Object(ref.Num)
+	}
+	return nil
+}
+
+func (r *pdfReader) dict(o pdfObject) pdfDict {
+	switch d := r.Resolve(o).(type) {
+	case pdfDict:
+		return d
+	case *pdfStream:
+		return d.Dict
+	}
+	return nil
+}
+
+func (r *pdfReader) array(o pdfObject) pdfArray {
+	a, _ := r.Resolve(o).(pdfArray)
+	return a
+}
+
+func (r *pdfReader) Root() (pdfDict, error) {
+	root := r.dict(r.trailer["Root"])
+	if root == nil || r.dict(root["Pages"]) == nil {
+		return nil, pdfError("pdfReader.Root", "document catalog not found")
+	}
+	return root, nil
+}
+
+// Decode stream data. Only FlateDecode is supported, that's enough for
+// cross reference and object streams.
+func (r *pdfReader) decode(s *pdfStream) ([]byte, error) {
+	filter := r.Resolve(s.Dict["Filter"])
+	if a, ok := filter.(pdfArray); ok && len(a) == 1 {
+		filter = r.Resolve(a[0])
+	}
+	switch filter {
+	case nil:
+		return s.Data, nil
+	case pdfName("FlateDecode"):
+	default:
+		return nil, pdfError("pdfReader.decode", "unsupported filter ", filter)
+	}
+	z, err := zlib.NewReader(bytes.NewReader(s.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+	parms := r.dict(s.Dict["DecodeParms"])
+	if a := r.array(s.Dict["DecodeParms"]); len(a) == 1 {
+		parms = r.dict(a[0])
+	}
+	if predictor, _ := r.Resolve(parms["Predictor"]).(int); predictor >= 10 {
+		columns, _ := r.Resolve(parms["Columns"]).(int)
+		if columns == 0 {
+			columns = 1
+		}
+		return pngUnpredict(data, columns)
+	}
+	return data, nil
+}
+
+// Revert PNG predictors, one byte per pixel
+func pngUnpredict(data []byte, columns int) ([]byte, error) {
+	row := columns + 1
+	out := make([]byte, 0, len(data)/row*columns)
+	prev := make([]byte, columns)
+	for i := 0; i+row <= len(data); i += row {
+		cur := make([]byte, columns)
+		copy(cur, data[i+1:i+row])
+		for j := range cur {
+			var left, upleft byte
+			if j > 0 {
+				left, upleft = cur[j-1], prev[j-1]
+			}
+			switch data[i] {
+			case 0:
+			case 1:
+				cur[j] += left
+			case 2:
+				cur[j] += prev[j]
+			case 3:
+				cur[j] += byte((int(left) + int(prev[j])) / 2)
+			case 4:
+				cur[j] += paeth(left, prev[j], upleft)
+			default:
+				return nil, pdfError("pngUnpredict", "unknown predictor ", data[i])
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// Pages of the document in reading order, with their original reference
+func (r *pdfReader) Pages() ([]pdfRef, error) {
+	root, err := r.Root()
+	if err != nil {
+		return nil, err
+	}
+	pages := []pdfRef{}
+	seen := make(map[int]bool)
+	var walk func(o pdfObject) error
+	walk = func(o pdfObject) error {
+		ref, ok := o.(pdfRef)
+		if !ok || seen[ref.Num] {
+			return pdfError("pdfReader.Pages", "bad page tree")
+		}
+		seen[ref.Num] = true
+		node := r.dict(ref)
+		if node == nil {
+			return pdfError("pdfReader.Pages", "page ", ref.Num, " not found")
+		}
+		if node["Type"] == pdfName("Page") || node["Kids"] == nil {
+			pages = append(pages, ref)
+			return nil
+		}
+		for _, kid := range r.array(node["Kids"]) {
+			if err := walk(kid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pagesRef, ok := root["Pages"].(pdfRef)
+	if !ok {
+		return nil, pdfError("pdfReader.Pages", "page tree must be an indirect object")
+	}
+	return pages, walk(pagesRef)
+}
+
+// Page attributes that can be inherited from the page tree
+var pdfInheritable = []pdfName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// Give the page dictionary with inherited attributes
+func (r *pdfReader) Page(ref pdfRef) pdfDict {
+	page := pdfDict{}
+	for k, v := range r.dict(ref) {
+		page[k] = v
+	}
+	parent := r.dict(page["Parent"])
+	for i := 0; parent != nil && i < 64; i++ {
+		for _, k := range pdfInheritable {
+			if _, ok := page[k]; !ok && parent[k] != nil {
+				page[k] = parent[k]
+			}
+		}
+		parent = r.dict(parent["Parent"])
+	}
+	return page
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Writer
+
+type pdfWriter struct {
+	version string
+	objects []pdfObject // Object n is objects[n-1]
+}
+
+func NewPDFWriter() *pdfWriter {
+	return &pdfWriter{version: "1.4"}
+}
+
+// Reserve an object number
+func (w *pdfWriter) Reserve() pdfRef {
+	w.objects = append(w.objects, nil)
+	return pdfRef{len(w.objects), 0}
+}
+
+func (w *pdfWriter) Set(ref pdfRef, o pdfObject) {
+	w.objects[ref.Num-1] = o
+}
+
+func (w *pdfWriter) Add(o pdfObject) pdfRef {
+	ref := w.Reserve()
+	w.Set(ref, o)
+	return ref
+}
+
+// Use the highest version of inputs
+func (w *pdfWriter) Version(v string) {
+	if v > w.version && len(v) == 3 {
+		w.version = v
+	}
+}
+
+func (w *pdfWriter) Write(out io.Writer, root, info pdfRef) error {
+	b := bufio.NewWriter(out)
+	cw := &countWriter{w: b}
+	fmt.Fprintf(cw, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", w.version)
+	offsets := make([]int64, len(w.objects))
+	for i, o := range w.objects {
+		offsets[i] = cw.n
+		fmt.Fprintf(cw, "%d 0 obj\n", i+1)
+		writePDFObject(cw, o)
+		fmt.Fprint(cw, "\nendobj\n")
+	}
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", len(w.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(cw, "%010d 00000 n \n", off)
+	}
+	trailer := pdfDict{"Size": len(w.objects) + 1, "Root": root}
+	if info.Num > 0 {
+		trailer["Info"] = info
+	}
+	fmt.Fprint(cw, "trailer\n")
+	writePDFObject(cw, trailer)
+	fmt.Fprintf(cw, "\nstartxref\n%d\n%%%%EOF\n", xref)
+	if cw.err != nil {
+		return cw.err
+	}
+	return b.Flush()
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func writePDFObject(w io.Writer, o pdfObject) {
+	switch v := o.(type) {
+	case nil:
+		io.WriteString(w, "null")
+	case bool:
+		fmt.Fprint(w, v)
+	case int:
+		io.WriteString(w, strconv.Itoa(v))
+	case float64:
+		io.WriteString(w, strconv.FormatFloat(v, 'f', -1, 64))
+	case pdfName:
+		io.WriteString(w, "/")
+		for _, c := range []byte(v) {
+			if c < 33 || c > 126 || c == '#' || isPDFDelimiter(c) {
+				fmt.Fprintf(w, "#%02x", c)
+			} else {
+				w.Write([]byte{c})
+			}
+		}
+	case pdfString:
+		io.WriteString(w, "(")
+		for _, c := range []byte(v) {
+			switch c {
+			case '\\', '(', ')':
+				w.Write([]byte{'\\', c})
+			case '\r':
+				io.WriteString(w, "\\r")
+			case '\n':
+				io.WriteString(w, "\\n")
+			default:
+				w.Write([]byte{c})
+			}
+		}
+		io.WriteString(w, ")")
+	case pdfRef:
+		fmt.Fprintf(w, "%d %d R", v.Num, v.Gen)
+	case pdfArray:
+		io.WriteString(w, "[")
+		for i, e := range v {
+			if i > 0 {
+				io.WriteString(w, " ")
+			}
+			writePDFObject(w, e)
+		}
+		io.WriteString(w, "]")
+	case pdfDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		io.WriteString(w, "<<")
+		for _, k := range keys {
+			writePDFObject(w, pdfName(k))
+			io.WriteString(w, " ")
+			writePDFObject(w, v[pdfName(k)])
+		}
+		io.WriteString(w, ">>")
+	case *pdfStream:
+		v.Dict["Length"] = len(v.Data)
+		writePDFObject(w, v.Dict)
+		io.WriteString(w, "\nstream\n")
+		w.Write(v.Data)
+		io.WriteString(w, "\nendstream")
+	default:
+		panic(fmt.Sprintf("writePDFObject: unexpected type %T", o))
+	}
+}
@@ -0,0 +1,200 @@
+// pdf_test.go
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Build a PDF with a classic cross reference table, objects are numbered from 1
+func buildPDF(objects []string, root int, badXref bool) []byte {
+	b := bytes.NewBufferString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, o := range objects {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	if badXref {
+		xref += 17
+	}
+	fmt.Fprintf(b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(b, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, root, xref)
+	return b.Bytes()
+}
+
+func textPage(text string) []string {
+	content := "BT /F1 12 Tf 72 720 Td 3 Tr (" + text + ") Tj ET"
+	return []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 /MediaBox [0 0 612 792] /Resources << /Font << /F1 5 0 R >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+}
+
+// Build a PDF 1.5 where page objects are in an object stream
+func buildCompressedPDF(text string) []byte {
+	content := "BT /F1 12 Tf 72 720 Td (" + text + ") Tj ET"
+	inStream := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+	}
+	header, body := "", ""
+	for i, o := range inStream {
+		header += fmt.Sprintf("%d %d ", i+1, len(body))
+		body += o + " "
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte(header + body))
+	zw.Close()
+
+	b := bytes.NewBufferString("%PDF-1.5\n")
+	off4 := b.Len()
+	fmt.Fprintf(b, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	off5 := b.Len()
+	b.WriteString("5 0 obj\n<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>\nendobj\n")
+	off6 := b.Len()
+	fmt.Fprintf(b, "6 0 obj\n<< /Type /ObjStm /N 3 /First %d /Filter /FlateDecode /Length %d >>\nstream\n", len(header), z.Len())
+	b.Write(z.Bytes())
+	b.WriteString("\nendstream\nendobj\n")
+
+	// Cross reference stream, W [1 2 1]
+	entries := [][]int{{0, 0, 255}, {2, 6, 0}, {2, 6, 1}, {2, 6, 2}, {1, off4, 0}, {1, off5, 0}, {1, off6, 0}, {1, 0, 0}}
+	off7 := b.Len()
+	entries[7][1] = off7
+	raw := []byte{}
+	for _, e := range entries {
+		raw = append(raw, byte(e[0]), byte(e[1]>>8), byte(e[1]), byte(e[2]))
+	}
+	fmt.Fprintf(b, "7 0 obj\n<< /Type /XRef /Size 8 /W [1 2 1] /Root 1 0 R /Length %d >>\nstream\n", len(raw))
+	b.Write(raw)
+	fmt.Fprintf(b, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", off7)
+	return b.Bytes()
+}
+
+func pageContent(t *testing.T, r *pdfReader, page pdfRef) string {
+	s, ok := r.Resolve(r.Page(page)["Contents"]).(*pdfStream)
+	if !ok {
+		t.Fatalf("no content for page %v", page)
+	}
+	return string(s.Data)
+}
+
+func Test_PDFReader(t *testing.T) {
+	for i, data := range [][]byte{
+		buildPDF(textPage("Hello"), 1, false),
+		buildPDF(textPage("Hello"), 1, true),
+		buildCompressedPDF("Hello"),
+	} {
+		r, err := NewPDFReader(data)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		pages, err := r.Pages()
+		if err != nil || len(pages) != 1 {
+			t.Fatalf("test %d: unexpected pages %v, %v", i, pages, err)
+		}
+		if c := pageContent(t, r, pages[0]); !strings.Contains(c, "(Hello) Tj") {
+			t.Errorf("test %d: unexpected content %q", i, c)
+		}
+		if r.dict(r.Page(pages[0])["Resources"]) == nil {
+			t.Errorf("test %d: resources not found", i)
+		}
+	}
+}
+
+func Test_PDFStrings(t *testing.T) {
+	p := &pdfParser{data: []byte(`[(a\(b\)c\\ \101 (nested)) <48656C6C6F> /A#20B 3.5 -2 12 0 R true null]`)}
+	o, err := p.parseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := o.(pdfArray)
+	if a[0] != pdfString(`a(b)c\ A (nested)`) || a[1] != pdfString("Hello") || a[2] != pdfName("A B") {
+		t.Errorf("unexpected values %q", a)
+	}
+	if a[3] != 3.5 || a[4] != -2 || a[5] != (pdfRef{12, 0}) || a[6] != true || a[7] != nil {
+		t.Errorf("unexpected values %v", a)
+	}
+	var b bytes.Buffer
+	writePDFObject(&b, a)
+	p = &pdfParser{data: b.Bytes()}
+	o2, err := p.parseObject()
+	if err != nil || fmt.Sprint(o2) != fmt.Sprint(o) {
+		t.Errorf("write and read back give %v, %v", o2, err)
+	}
+}
+
+func Test_MergePDF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputs := []string{}
+	for i, data := range [][]byte{
+		buildPDF(textPage("Page one"), 1, false),
+		buildCompressedPDF("Page two"),
+		buildPDF(textPage("Page three"), 1, true),
+	} {
+		name := filepath.Join(dir, fmt.Sprintf("ocr-page-%04d.jpg.pdf", i))
+		ioutil.WriteFile(name, data, 0644)
+		inputs = append(inputs, name)
+	}
+	output := filepath.Join(dir, "document.pdf")
+	if err = MergePDF(output, inputs, map[string]string{"Title": "Test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ReadPDFFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.version != "1.5" {
+		t.Errorf("unexpected version %s", r.version)
+	}
+	pages, err := r.Pages()
+	if err != nil || len(pages) != 3 {
+		t.Fatalf("unexpected pages %v, %v", pages, err)
+	}
+	for i, text := range []string{"Page one", "Page two", "Page three"} {
+		if c := pageContent(t, r, pages[i]); !strings.Contains(c, "("+text+") Tj") {
+			t.Errorf("page %d: unexpected content %q", i, c)
+		}
+		page := r.dict(pages[i])
+		if page["Resources"] == nil || page["MediaBox"] == nil {
+			t.Errorf("page %d: inherited attributes are lost", i)
+		}
+		font := r.dict(r.dict(r.dict(page["Resources"])["Font"])["F1"])
+		if font["Type"] != pdfName("Font") {
+			t.Errorf("page %d: font is lost", i)
+		}
+	}
+	info := r.dict(r.trailer["Info"])
+	if info["Title"] != pdfString("Test") {
+		t.Errorf("unexpected info %v", info)
+	}
+	// The written file must have a valid cross reference
+	r.xref = make(map[int]xrefEntry)
+	if err = r.readXref(); err != nil {
+		t.Fatal(err)
+	}
+	for n, e := range r.xref {
+		if num, _, err := r.parseIndirect(e.offset); err != nil || num != n {
+			t.Errorf("bad cross reference for object %d: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// pdfmerge.go
+package main
+
+/*
+	Join PDF pages into the final document without external tool.
+	Each page is copied with every object it uses: contents, resources,
+	fonts, images and annotations. Text layers are kept as they are.
+*/
+
+import (
+	"os"
+	"time"
+)
+
+// Copy objects from a source document to the writer, each source object is
+// copied once.
+type pdfCopier struct {
+	r    *pdfReader
+	w    *pdfWriter
+	refs map[int]pdfRef // Source object number -> new reference
+}
+
+func (c *pdfCopier) ref(src pdfRef) pdfRef {
+	if ref, ok := c.refs[src.Num]; ok {
+		return ref
+	}
+	ref := c.w.Reserve()
+	c.refs[src.Num] = ref
+	c.w.Set(ref, c.copy(c.r.Object(src.Num)))
+	return ref
+}
+
+func (c *pdfCopier) copy(o pdfObject) pdfObject {
+	switch v := o.(type) {
+	case pdfRef:
+		return c.ref(v)
+	case pdfArray:
+		a := make(pdfArray, len(v))
+		for i, e := range v {
+			a[i] = c.copy(e)
+		}
+		return a
+	case pdfDict:
+		d := pdfDict{}
+		for k, e := range v {
+			d[k] = c.copy(e)
+		}
+		return d
+	case *pdfStream:
+		d := c.copy(v.Dict).(pdfDict)
+		return &pdfStream{Dict: d, Data: v.Data}
+	}
+	return o
+}
+
+// Copy a page, and attach it to the new page tree
+func (c *pdfCopier) page(src pdfRef, parent pdfRef) pdfRef {
+	ref, ok := c.refs[src.Num]
+	if !ok {
+		ref = c.w.Reserve()
+		c.refs[src.Num] = ref
+	}
+	page := pdfDict{}
+	for k, v := range c.r.Page(src) {
+		switch k {
+		case "Parent", "StructParents", "B":
+			// Structure tree and article threads are not copied
+		default:
+			page[k] = c.copy(v)
+		}
+	}
+	page["Type"] = pdfName("Page")
+	page["Parent"] = parent
+	c.w.Set(ref, page)
+	return ref
+}
+
+// Join pages of input files into the output file
+func MergePDF(output string, inputs []string, info map[string]string) error {
+	defer Un(Trace("MergePDF", output))
+	w := NewPDFWriter()
+	pagesRef := w.Reserve()
+	kids := pdfArray{}
+	for _, in := range inputs {
+		r, err := ReadPDFFile(in)
+		if err != nil {
+			return err
+		}
+		w.Version(r.version)
+		pages, err := r.Pages()
+		if err != nil {
+			return NewDocumentError("MergePDF", in, err)
+		}
+		c := &pdfCopier{r: r, w: w, refs: make(map[int]pdfRef)}
+		for _, p := range pages {
+			kids = append(kids, c.page(p, pagesRef))
+		}
+	}
+	if len(kids) == 0 {
+		return NewDocumentError("MergePDF", "no page to write in "+output)
+	}
+	w.Set(pagesRef, pdfDict{"Type": pdfName("Pages"), "Kids": kids, "Count": len(kids)})
+	root := w.Add(pdfDict{"Type": pdfName("Catalog"), "Pages": pagesRef})
+	infoRef := w.Add(PDFInfo(info))
+
+	f, err := os.Create(output)
+	if err != nil {
+		return NewDocumentError("MergePDF", output, err)
+	}
+	err = w.Write(f, root, infoRef)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return NewDocumentError("MergePDF", output, err)
+	}
+	return nil
+}
+
+// Build the document information dictionary
+func PDFInfo(info map[string]string) pdfDict {
+	d := pdfDict{
+		"Producer":     pdfString("scantopc " + VERSION),
+		"CreationDate": pdfString(pdfDate(time.Now())),
+	}
+	for k, v := range info {
+		d[pdfName(k)] = pdfString(v)
+	}
+	return d
+}
+
+// Date in PDF format: D:YYYYMMDDHHmmSS+HH'mm'
+func pdfDate(t time.Time) string {
+	z := t.Format("-0700")
+	return t.Format("D:20060102150405") + z[:3] + "'" + z[3:] + "'"
+}
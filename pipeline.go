@@ -0,0 +1,206 @@
+// pipeline.go
+package main
+
+/*
+	Per destination processing pipeline
+
+	Each page received from the scanner goes through the ordered list of steps
+	given by the destination:
+
+		[[destination]]
+		name = "OCR"
+		filepattern = "~/Documents/%Y%m%d-%H%M%S"
+		ocr = true
+
+		[[destination.step]]
+		name = "deskew"
+		options = { threshold = "40%" }
+
+		[[destination.step]]
+		name = "ocr"
+
+		[[destination.step]]
+		name = "make-pdf"
+
+	Steps are orient (see orient.go), deskew, crop, normalize, binarize,
+	compress (see imageproc.go), colormode (see colormode.go), ocr and
+	make-pdf. Options and their values are checked with the configuration.
+
+	When no step is given, the pipeline is deskew, ocr, make-pdf for OCR
+	destinations, and deskew, make-pdf for others. The make-pdf step is added
+	at the end of the pipeline when omitted.
+
+	make-pdf writes the page itself, with the OCR text layer when present.
+	hocr2pdf can still be used with options = { tool = "hocr2pdf" }.
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Step struct {
+	Name    string                 `toml:"name"`
+	Options map[string]interface{} `toml:"options"`
+}
+
+// Give the value of the option, or the default value when not set
+func (s Step) Option(name, def string) string {
+	if v, ok := s.Options[name]; ok {
+		return fmt.Sprint(v)
+	}
+	return def
+}
+
+type stepDefinition struct {
+	run      func(ij *imageJob, s Step) error
+	check    func(s Step) error  // Check values of options
+	options  []string            // Accepted options
+	tools    map[string][]string // External tools needed by the step, by value of its tool option
+	geometry bool                // The step changes the image geometry
+}
+
+var pipelineSteps = map[string]stepDefinition{
+	"deskew": stepDefinition{
+		run:      (*imageJob).DeskewImage,
+		check:    func(s Step) error { _, err := deskewOptions(s); return err },
+		options:  []string{"tool", "maxangle", "fuzz", "threshold"},
+		tools:    map[string][]string{"native": nil, "convert": {"convert"}},
+		geometry: true,
+	},
+	"orient": stepDefinition{
+		run:      (*imageJob).OrientImage,
+		options:  []string{"tool"},
+		tools:    map[string][]string{"native": nil, "tesseract": {"tesseract"}},
+		geometry: true,
+	},
+	"crop": stepDefinition{
+		run:      (*imageJob).CropImage,
+		check:    func(s Step) error { _, err := cropOptions(s); return err },
+		options:  []string{"tool", "fuzz"},
+		tools:    map[string][]string{"native": nil, "convert": {"convert"}},
+		geometry: true,
+	},
+	"normalize": stepDefinition{
+		run:     (*imageJob).NormalizeImage,
+		check:   func(s Step) error { _, _, err := normalizeOptions(s); return err },
+		options: []string{"black", "white"},
+	},
+	"binarize": stepDefinition{
+		run:     (*imageJob).BinarizeImage,
+		check:   func(s Step) error { _, _, err := binarizeOptions(s); return err },
+		options: []string{"window", "k"},
+	},
+	"compress": stepDefinition{
+		run:     (*imageJob).CompressImage,
+		check:   func(s Step) error { _, err := compressOptions(s); return err },
+		options: []string{"tool", "quality"},
+		tools:   map[string][]string{"native": nil, "convert": {"convert"}},
+	},
+	"colormode": stepDefinition{
+		run:     (*imageJob).ColorModeImage,
+		check:   func(s Step) error { _, err := colorModeOptions(s); return err },
+		options: []string{"color"},
+	},
+	"ocr": stepDefinition{
+		run:   (*imageJob).OCRImage,
+		tools: map[string][]string{"native": {"tesseract"}},
+	},
+	"make-pdf": stepDefinition{
+		run:     (*imageJob).MakePDF,
+		options: []string{"tool"},
+		tools:   map[string][]string{"native": nil, "hocr2pdf": {"hocr2pdf"}},
+	},
+}
+
+// Pipeline used when the destination doesn't give one
+func DefaultPipeline(doOCR bool) []Step {
+	if doOCR {
+		return []Step{Step{Name: "deskew"}, Step{Name: "ocr"}, Step{Name: "make-pdf"}}
+	}
+	return []Step{Step{Name: "deskew"}, Step{Name: "make-pdf"}}
+}
+
+// Check the pipeline of the destination
+func (d *Destination) CheckPipeline() error {
+	seen := make(map[string]bool)
+	for i, s := range d.Steps {
+		def, ok := pipelineSteps[s.Name]
+		if !ok {
+			return NewDocumentError("Destination.CheckPipeline", fmt.Sprint("unknown step '", s.Name, "' for destination ", d.Name, ", known steps are ", StepNames()))
+		}
+		for o := range s.Options {
+			if !contains(def.options, o) {
+				return NewDocumentError("Destination.CheckPipeline", fmt.Sprint("unknown option '", o, "' for step ", s.Name, " of destination ", d.Name))
+			}
+		}
+		if seen[s.Name] {
+			return NewDocumentError("Destination.CheckPipeline", "step "+s.Name+" is given twice for destination "+d.Name)
+		}
+		if def.check != nil {
+			if err := def.check(s); err != nil {
+				return NewDocumentError("Destination.CheckPipeline", "step "+s.Name+" of destination "+d.Name, err)
+			}
+		}
+		seen[s.Name] = true
+		if _, ok := def.tools[s.Option("tool", "native")]; !ok && s.Option("tool", "native") != "native" {
+			return NewDocumentError("Destination.CheckPipeline", "unknown "+s.Name+" tool "+s.Option("tool", "")+" for destination "+d.Name)
+		}
+		if seen["make-pdf"] && i < len(d.Steps)-1 {
+			return NewDocumentError("Destination.CheckPipeline", "make-pdf must be the last step of destination "+d.Name)
+		}
+		if def.geometry && seen["ocr"] {
+			// Words positions given by OCR wouldn't match the image anymore
+			return NewDocumentError("Destination.CheckPipeline", "step "+s.Name+" can't run after ocr for destination "+d.Name)
+		}
+	}
+	if seen["ocr"] != d.DoOCR {
+		return NewDocumentError("Destination.CheckPipeline", fmt.Sprint("ocr step and ocr = ", d.DoOCR, " are inconsistent for destination ", d.Name))
+	}
+	return nil
+}
+
+// External tools needed by the pipeline
+func (d *Destination) PipelineTools() []string {
+	tools := []string{}
+	hasOCR := false
+	for _, s := range d.Steps {
+		switch s.Name {
+		case "ocr":
+			hasOCR = true
+		case "make-pdf":
+			// hocr2pdf is used on request when there is a text layer
+			if hasOCR && s.Option("tool", "native") == "hocr2pdf" {
+				tools = append(tools, "hocr2pdf")
+			}
+			continue
+		}
+		tools = append(tools, pipelineSteps[s.Name].tools[s.Option("tool", "native")]...)
+	}
+	if d.Separator == separatorQR || d.Separator == separatorAny {
+		tools = append(tools, "zbarimg")
+	}
+	if d.Compression.Bilevel == bilevelJBIG2 {
+		tools = append(tools, "jbig2")
+	}
+	return tools
+}
+
+func StepNames() string {
+	l := []string{}
+	for n := range pipelineSteps {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ", ")
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// pipeline_test.go
+package main
+
+import (
+	"testing"
+)
+
+func Test_CheckPipeline(t *testing.T) {
+	tests := []struct {
+		doOCR bool
+		steps []Step
+		ok    bool
+	}{
+		{true, []Step{{Name: "deskew"}, {Name: "ocr"}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "crop"}, {Name: "compress", Options: map[string]interface{}{"quality": 60}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "sharpen"}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "deskew", Options: map[string]interface{}{"quality": 60}}, {Name: "make-pdf"}}, false},
+		{true, []Step{{Name: "ocr"}, {Name: "deskew"}, {Name: "make-pdf"}}, false},
+		{true, []Step{{Name: "ocr"}, {Name: "make-pdf"}, {Name: "compress"}}, false},
+		{false, []Step{{Name: "deskew"}, {Name: "deskew"}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "ocr"}, {Name: "make-pdf"}}, false},
+		{true, []Step{{Name: "deskew"}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "make-pdf", Options: map[string]interface{}{"tool": "gs"}}}, false},
+		{false, []Step{{Name: "crop", Options: map[string]interface{}{"tool": "convert"}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "normalize"}, {Name: "binarize", Options: map[string]interface{}{"window": 31}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "deskew", Options: map[string]interface{}{"maxangle": "five"}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "deskew", Options: map[string]interface{}{"tool": "convert", "threshold": "40%"}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "deskew", Options: map[string]interface{}{"tool": "convert", "fuzz": "150%"}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "crop", Options: map[string]interface{}{"fuzz": "-5%"}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "normalize", Options: map[string]interface{}{"white": "1.5%", "black": "dark"}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "compress", Options: map[string]interface{}{"quality": 0}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "binarize", Options: map[string]interface{}{"window": 1}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "binarize", Options: map[string]interface{}{"k": "high"}}, {Name: "make-pdf"}}, false},
+		{false, []Step{{Name: "binarize", Options: map[string]interface{}{"k": 0.34}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "colormode", Options: map[string]interface{}{"color": "0.5%"}}, {Name: "make-pdf"}}, true},
+		{false, []Step{{Name: "colormode", Options: map[string]interface{}{"color": "some"}}, {Name: "make-pdf"}}, false},
+	}
+	for i, test := range tests {
+		d := Destination{Name: "test", DoOCR: test.doOCR, Steps: test.steps}
+		err := d.CheckPipeline()
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func Test_PipelineTools(t *testing.T) {
+	d := Destination{Steps: []Step{{Name: "crop"}, {Name: "make-pdf"}}}
+	if tools := d.PipelineTools(); len(tools) != 0 {
+		t.Errorf("unexpected tools %v", tools)
+	}
+	d.Steps[0].Options = map[string]interface{}{"tool": "convert"}
+	if tools := d.PipelineTools(); len(tools) != 1 || tools[0] != "convert" {
+		t.Errorf("unexpected tools %v", tools)
+	}
+	d = Destination{Steps: DefaultPipeline(true)}
+	if tools := d.PipelineTools(); len(tools) != 1 || tools[0] != "tesseract" {
+		t.Errorf("unexpected tools %v", tools)
+	}
+	d.Steps[2].Options = map[string]interface{}{"tool": "hocr2pdf"}
+	if tools := d.PipelineTools(); len(tools) != 2 || tools[1] != "hocr2pdf" {
+		t.Errorf("unexpected tools %v", tools)
+	}
+}
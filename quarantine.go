@@ -0,0 +1,101 @@
+// quarantine.go
+package main
+
+/*
+	Quarantine of failed batches
+
+	When a page can't be processed, it's included in the document as the
+	image received from the scanner, without text. The batch is then copied
+	in the quarantine folder, with raw images of all pages and a report giving
+	the output of each tool launched for the pages:
+
+		quarantine = "/var/spool/scantopc/quarantine"
+
+	By default, the quarantine folder is next to the log file. Each batch has
+	its own sub-folder named from the destination and the scan time.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Folder where failed batches are kept
+func (c *Config) QuarantineFolder() string {
+	if c.Quarantine != "" {
+		return c.Quarantine
+	}
+	if logFile != nil {
+		return filepath.Join(filepath.Dir(logFile.Name()), "scantopc-quarantine")
+	}
+	return filepath.Join(os.TempDir(), "scantopc-quarantine")
+}
+
+// Copy raw images of a failed batch in the quarantine folder, with the
+// report of tools outputs. Give the batch folder.
+func (bm *OCRBatchImageManager) Quarantine(imagelist []*imageJob, docErr error) (string, error) {
+	folder := filepath.Join(bm.config.QuarantineFolder(), bm.settings.Name+"-"+bm.when.Format("20060102-150405"))
+	if bm.index > 0 {
+		// Document of a batch split by separator sheets
+		folder += fmt.Sprintf("-%02d", bm.index)
+	}
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		ERROR.Println("OCRBatchImageManager.Quarantine", err)
+		return "", err
+	}
+	for i, ij := range imagelist {
+		// Recto and verso pages have the same names
+		name := filepath.Join(folder, fmt.Sprintf("%03d-%s", i+1, filepath.Base(ij.filename)))
+		if _, err := CopyFile(ij.filename, name); err != nil {
+			// The report is written anyway, with other pages
+			ERROR.Println("OCRBatchImageManager.Quarantine", "page", i+1, "not kept:", err)
+		}
+	}
+	f, err := os.Create(filepath.Join(folder, "report.txt"))
+	if err != nil {
+		ERROR.Println("OCRBatchImageManager.Quarantine", err)
+		return folder, err
+	}
+	defer f.Close()
+	bm.WriteReport(f, imagelist, docErr)
+	WARNING.Println("Batch", bm.settings.Name, bm.when.Format("2006-01-02 15:04:05"), "is kept in", folder)
+	return folder, nil
+}
+
+// Write the report of a batch: document status, then each page with the
+// outputs of tools launched for it
+func (bm *OCRBatchImageManager) WriteReport(w io.Writer, imagelist []*imageJob, docErr error) {
+	fmt.Fprintf(w, "Batch %s %s, format %s\n", bm.settings.Name, bm.when.Format("2006-01-02 15:04:05"), bm.doctype)
+	fmt.Fprintf(w, "Document: %s\n", bm.filename)
+	if docErr != nil {
+		fmt.Fprintf(w, "Document error: %v\n", docErr)
+	}
+	for i, ij := range imagelist {
+		status := "ok"
+		switch {
+		case ij.lost:
+			status = "lost"
+		case ij.plain:
+			status = "included as plain image"
+		}
+		fmt.Fprintf(w, "\nPage %d %s: %s\n", i+1, ij.filename, status)
+		if ij.err != nil {
+			fmt.Fprintf(w, "Error in step %s: %v\n", ij.step, ij.err)
+		}
+		for _, r := range ij.report {
+			fmt.Fprintf(w, "--- %s: %s\n", r.Context, r.Command)
+			if r.Output != "" {
+				io.WriteString(w, r.Output)
+				if r.Output[len(r.Output)-1] != '\n' {
+					io.WriteString(w, "\n")
+				}
+			}
+			if r.Err != nil {
+				fmt.Fprintf(w, "Failed: %v\n", r.Err)
+			}
+		}
+	}
+}
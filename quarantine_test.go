@@ -0,0 +1,98 @@
+// quarantine_test.go
+package main
+
+import (
+	"errors"
+	"github.com/simulot/hpdevices"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PlainPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ij := &imageJob{
+		filename:    filepath.Join(dir, "page-0000.jpg"),
+		destination: &Destination{Resolution: 100},
+		format:      ".pdf",
+		hocr:        "missing.hocr",
+	}
+	writeTestJPEG(t, ij.filename, 20, 20)
+	ij.PlainPage()
+	if !ij.plain || ij.lost || ij.hocr != "" {
+		t.Errorf("unexpected page state %+v", ij)
+	}
+	if _, err := ReadPDFFile(ij.PDFName()); err != nil {
+		t.Error("plain page not written", err)
+	}
+
+	ij = &imageJob{
+		filename:    filepath.Join(dir, "page-0001.jpg"),
+		destination: &Destination{Resolution: 100},
+		format:      ".pdf",
+	}
+	ioutil.WriteFile(ij.filename, []byte("not a jpeg"), 0644)
+	ij.PlainPage()
+	if !ij.lost {
+		t.Errorf("page with a broken image should be lost")
+	}
+}
+
+func Test_Quarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bm := &OCRBatchImageManager{
+		settings: &hpdevices.DestinationSettings{Name: "OCR"},
+		config:   &Config{Quarantine: filepath.Join(dir, "quarantine")},
+		doctype:  "PDF",
+		filename: "/home/user/scan.pdf",
+		when:     time.Date(2014, 1, 4, 19, 8, 31, 0, time.Local),
+	}
+	images := []*imageJob{
+		{filename: filepath.Join(dir, "page-0000.jpg")},
+		{filename: filepath.Join(dir, "page-0001.jpg"), err: errors.New("exit status 1"), step: "ocr", plain: true,
+			report: []toolRun{{"imageJob.OCRImage", "tesseract page-0001.jpg", errors.New("exit status 1"), "Error opening data file"}}},
+		{filename: filepath.Join(dir, "page-0002.jpg"), lost: true},
+	}
+	for _, ij := range images[:2] {
+		ioutil.WriteFile(ij.filename, []byte("image"), 0644)
+	}
+	folder, err := bm.Quarantine(images, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != filepath.Join(dir, "quarantine", "OCR-20140104-190831") {
+		t.Errorf("unexpected folder %s", folder)
+	}
+	for _, name := range []string{"001-page-0000.jpg", "002-page-0001.jpg"} {
+		if _, err := os.Stat(filepath.Join(folder, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(folder, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(b)
+	for _, s := range []string{
+		"Page 1 " + images[0].filename + ": ok",
+		"Page 2 " + images[1].filename + ": included as plain image",
+		"Error in step ocr: exit status 1",
+		"Page 3 " + images[2].filename + ": lost",
+		"--- imageJob.OCRImage: tesseract page-0001.jpg\nError opening data file\nFailed: exit status 1\n",
+	} {
+		if !strings.Contains(report, s) {
+			t.Errorf("report should contain %q:\n%s", s, report)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// separator.go
+package main
+
+/*
+	Separator sheets
+
+	A stack of several documents is scanned in one batch, with a separator
+	sheet put before each document. Each document is written on its own,
+	separator sheets are left out:
+
+		[[destination]]
+		name = "Mail"
+		filepattern = "~/Mail/%Y%m%d-%H%M%S-%i"
+		separator = "any"         # patch, qr or any. Default is no separator
+
+	Separator sheets are recognised before the processing of pages:
+		patch     a patch code sheet, whatever the code
+		qr        a QR code with scantopc:separator as content. Pages having
+		          other QR codes are part of documents. zbarimg is needed.
+
+	The QR code can give the destination where the next document goes, and
+	its title:
+
+		scantopc:separator?destination=Invoices&title=Electricity%20bill
+
+	The document is written with the file pattern, owner, modes and collision
+	policy of that destination. Its format, pipeline and other settings are
+	the ones of the batch, pages have already been processed.
+
+	When a document can't be written, or has failed pages, only its pages are
+	quarantined.
+
+	%i in the file pattern is the index of the document in the batch, %t is
+	its title. When none of them is used, -01, -02... are added to document
+	names.
+*/
+
+import (
+	"image"
+	"net/url"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Separator kinds
+const (
+	separatorPatch = "patch"
+	separatorQR    = "qr"
+	separatorAny   = "any"
+)
+
+// Content of separator QR codes
+const separatorQRContent = "scantopc:separator"
+
+// Separator sheet found in a batch
+type Separator struct {
+	Kind        string
+	Destination string `json:",omitempty"` // Destination of the next document
+	Title       string `json:",omitempty"` // Title of the next document
+}
+
+// Check if the received page is a separator sheet
+func (ij *imageJob) DetectSeparator() bool {
+	kind := ij.destination.Separator
+	if kind == separatorQR || kind == separatorAny {
+		if s := ij.separatorQR(); s != nil {
+			ij.separator = s
+		}
+	}
+	if ij.separator == nil && (kind == separatorPatch || kind == separatorAny) {
+		img, err := ReadJPEG(ij.filename)
+		if err != nil {
+			ERROR.Println("imageJob.DetectSeparator", err)
+			return false
+		}
+		if IsPatchSheet(img, ij.destination.Resolution) {
+			ij.separator = &Separator{Kind: separatorPatch}
+		}
+	}
+	if ij.separator != nil {
+		INFO.Println("Page", ij.filename, "is a", ij.separator.Kind, "separator sheet", ij.separator.Destination, ij.separator.Title)
+	}
+	return ij.separator != nil
+}
+
+// Read QR codes of the page with zbarimg
+func (ij *imageJob) separatorQR() *Separator {
+	cmd := exec.Command("zbarimg", "--quiet", "--raw", "-Sdisable", "-Sqrcode.enable", ij.filename)
+	out, err := TimeOutCombinedOutput(time.Minute, cmd)
+	ij.report = append(ij.report, toolRun{"imageJob.DetectSeparator", strings.Join(cmd.Args, " "), err, string(out)})
+	if err != nil {
+		// zbarimg exits with status 4 when there is no code
+		if e, ok := err.(*exec.ExitError); !ok || e.Sys().(syscall.WaitStatus).ExitStatus() != 4 {
+			ERROR.Println("imageJob.DetectSeparator", "Command zbarimg has failed", err)
+		}
+		return nil
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		if s := ParseSeparatorQR(strings.TrimSpace(l)); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// Separator given by the content of a QR code, nil for other codes
+func ParseSeparatorQR(content string) *Separator {
+	if !strings.HasPrefix(content, separatorQRContent) {
+		return nil
+	}
+	u, err := url.Parse(content)
+	if err != nil || u.Scheme+":"+u.Opaque != separatorQRContent {
+		return nil
+	}
+	q := u.Query()
+	return &Separator{
+		Kind:        separatorQR,
+		Destination: q.Get("destination"),
+		Title:       fileNameText(q.Get("title")),
+	}
+}
+
+// Text usable in a file name
+func fileNameText(s string) string {
+	return strings.TrimLeft(strings.Map(func(r rune) rune {
+		if r < ' ' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, s), ".")
+}
+
+// A patch code sheet has 4 parallel bars along most of its length, and
+// almost nothing else. Bars are at least 1/20 inch wide.
+func IsPatchSheet(img image.Image, dpi int) bool {
+	g := luminance(img)
+	w, h := g.Rect.Dx(), g.Rect.Dy()
+	threshold := otsuThreshold(g)
+	rows, cols := make([]int, h), make([]int, w)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if g.Pix[y*w+x] <= threshold {
+				rows[y]++
+				cols[x]++
+			}
+		}
+	}
+	return patchBars(cols, h, dpi/20) || patchBars(rows, w, dpi/20)
+}
+
+func patchBars(profile []int, length, minWidth int) bool {
+	bars, barInk, ink := 0, 0, 0
+	for _, v := range profile {
+		ink += v
+	}
+	for i := 0; i < len(profile); {
+		if profile[i] < length*2/5 {
+			i++
+			continue
+		}
+		j := i
+		for ; j < len(profile) && profile[j] >= length*2/5; j++ {
+			barInk += profile[j]
+		}
+		if j-i < minWidth {
+			return false
+		}
+		bars++
+		i = j
+	}
+	// Some text is printed on patch sheets
+	return bars == 4 && ink-barInk < barInk/4
+}
+
+// Settings of the destination for a document routed to target by a
+// separator sheet: only the output settings of the target are used
+func (d *Destination) RoutedTo(target *Destination) *Destination {
+	routed := *d
+	routed.FilePattern = target.FilePattern
+	routed.Owner, routed.Mode, routed.DirMode = target.Owner, target.Mode, target.DirMode
+	routed.Collision = target.Collision
+	return &routed
+}
+
+func hasFailedPages(pages []*imageJob) bool {
+	for _, ij := range pages {
+		if ij.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Split the page list of a batch into documents at separator sheets
+func SplitDocuments(pages []*imageJob) [][]*imageJob {
+	docs := [][]*imageJob{}
+	doc := []*imageJob{}
+	for _, ij := range pages {
+		if ij.separator == nil {
+			doc = append(doc, ij)
+			continue
+		}
+		if len(doc) > 0 {
+			docs = append(docs, doc)
+		}
+		doc = []*imageJob{ij}
+	}
+	if len(doc) > 0 {
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// The batch has separator sheets
+func HasSeparators(pages []*imageJob) bool {
+	for _, ij := range pages {
+		if ij != nil && ij.separator != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a document for each part of the batch. The first page of a part
+// is its separator sheet, when it has one.
+func (bm *OCRBatchImageManager) CombineDocuments(imagelist []*imageJob) error {
+	var firstErr error
+	index := 0
+	bm.split = true
+	for _, pages := range SplitDocuments(imagelist) {
+		doc := *bm
+		settings := *bm.settings
+		doc.settings = &settings
+		doc.files = nil
+		if s := pages[0].separator; s != nil {
+			pages = pages[1:]
+			if len(pages) == 0 {
+				continue
+			}
+			doc.title = s.Title
+			if s.Destination != "" {
+				if d := bm.config.destination(s.Destination); d != nil {
+					doc.destination = bm.destination.RoutedTo(d)
+					pattern := d.FilePattern
+					doc.settings.FilePattern = &pattern
+				} else {
+					WARNING.Println("Unknown destination", s.Destination, "given by separator sheet, document goes to", bm.destination.Name)
+				}
+			}
+		}
+		index++
+		doc.index = index
+		err := doc.CombinePages(pages)
+		if err != nil || hasFailedPages(pages) {
+			doc.Quarantine(pages, err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		INFO.Println("Document", index, "of the batch written to", doc.filename)
+		bm.files = append(bm.files, doc.files...)
+	}
+	if index == 0 && firstErr == nil {
+		return NewDocumentError("OCRBatchImageManager.CombineDocuments", "no page to write")
+	}
+	return firstErr
+}
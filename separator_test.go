@@ -0,0 +1,163 @@
+// separator_test.go
+package main
+
+import (
+	"github.com/simulot/hpdevices"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ParseSeparatorQR(t *testing.T) {
+	for _, c := range []struct {
+		content string
+		ok      bool
+		dest    string
+		title   string
+	}{
+		{"scantopc:separator", true, "", ""},
+		{"scantopc:separator?destination=Invoices&title=Electricity%20bill", true, "Invoices", "Electricity bill"},
+		{"scantopc:separator?title=../a/b", true, "", "_a_b"},
+		{"https://example.com/invoice", false, "", ""},
+		{"scantopc:separatorx", false, "", ""},
+	} {
+		s := ParseSeparatorQR(c.content)
+		if (s != nil) != c.ok || s != nil && (s.Destination != c.dest || s.Title != c.title) {
+			t.Errorf("%s: unexpected separator %+v", c.content, s)
+		}
+	}
+}
+
+// Patch code sheet with bars of the given widths
+func testPatchSheet(widths []int) *image.Gray {
+	g := image.NewGray(image.Rect(0, 0, 300, 400))
+	for i := range g.Pix {
+		g.Pix[i] = 0xff
+	}
+	x := 100
+	for _, w := range widths {
+		for y := 50; y < 350; y++ {
+			for i := 0; i < w; i++ {
+				g.Pix[y*300+x+i] = 0
+			}
+		}
+		x += w + 10
+	}
+	return g
+}
+
+func Test_IsPatchSheet(t *testing.T) {
+	if !IsPatchSheet(testPatchSheet([]int{6, 15, 6, 15}), 100) {
+		t.Errorf("patch sheet not detected")
+	}
+	if !IsPatchSheet(RotateRight(testPatchSheet([]int{15, 6, 15, 6}), 90), 100) {
+		t.Errorf("landscape patch sheet not detected")
+	}
+	if IsPatchSheet(testPatchSheet([]int{6, 15, 6}), 100) {
+		t.Errorf("3 bars detected as a patch sheet")
+	}
+	if IsPatchSheet(testPatchSheet([]int{1, 1, 1, 1}), 100) {
+		t.Errorf("thin lines detected as a patch sheet")
+	}
+	if IsPatchSheet(testPage(300, 400), 100) {
+		t.Errorf("text page detected as a patch sheet")
+	}
+}
+
+func Test_CombineDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "mail-%i")
+	// Output settings only are taken from the destination given by the QR code
+	config := &Config{Destinations: []Destination{{Name: "Invoices", FilePattern: filepath.Join(dir, "invoice-%t"), Zip: true}}}
+	bm := &OCRBatchImageManager{
+		settings:    &hpdevices.DestinationSettings{Name: "Mail", FilePattern: &pattern},
+		destination: &Destination{Name: "Mail", Separator: separatorAny},
+		config:      config,
+		format:      ".jpg",
+		when:        time.Now(),
+	}
+	pages := []*imageJob{}
+	for i := 0; i < 6; i++ {
+		ij := &imageJob{filename: filepath.Join(dir, JPEGPageName("page", i)+".jpg")}
+		ij.current = ij.filename
+		writeTestJPEG(t, ij.filename, 10, 10)
+		pages = append(pages, ij)
+	}
+	// Pages 1 2 | separator, 4 to Invoices | separator, 6
+	pages[2].separator = &Separator{Kind: separatorQR, Destination: "Invoices", Title: "Gas"}
+	pages[4].separator = &Separator{Kind: separatorPatch}
+	if docs := SplitDocuments(pages); len(docs) != 3 || len(docs[0]) != 2 || len(docs[1]) != 2 || len(docs[2]) != 2 {
+		t.Fatalf("unexpected split %v", docs)
+	}
+	if err = bm.CombineDocuments(pages); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mail-01-001.jpg", "mail-01-002.jpg", "invoice-Gas-001.jpg", "mail-03-001.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if !bm.split || len(bm.files) != 4 {
+		t.Errorf("unexpected files %v", bm.files)
+	}
+}
+
+func Test_ExpandName(t *testing.T) {
+	when := time.Date(2009, time.March, 10, 15, 53, 10, 0, time.Local)
+	if s, _ := ExpandName("%Y%m%d-%i %t", when, nameValues{index: 2, title: "Bill"}); s != "20090310-02 Bill" {
+		t.Errorf("unexpected name %s", s)
+	}
+	if s, _ := ExpandString("%Y-%i", when); s != "2009-01" {
+		t.Errorf("unexpected name %s", s)
+	}
+}
+
+func Test_CombineDocumentsFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pattern := filepath.Join(dir, "mail-%i")
+	config := &Config{
+		Quarantine:   filepath.Join(dir, "quarantine"),
+		Destinations: []Destination{{Name: "Invoices", FilePattern: filepath.Join(dir, "invoice-%t"), Collision: collisionFail}},
+	}
+	bm := &OCRBatchImageManager{
+		settings:    &hpdevices.DestinationSettings{Name: "Mail", FilePattern: &pattern},
+		destination: &Destination{Name: "Mail", Separator: separatorAny},
+		config:      config,
+		format:      ".jpg",
+		when:        time.Now(),
+	}
+	pages := []*imageJob{}
+	for i := 0; i < 4; i++ {
+		ij := &imageJob{filename: filepath.Join(dir, JPEGPageName("page", i)+".jpg")}
+		ij.current = ij.filename
+		writeTestJPEG(t, ij.filename, 10, 10)
+		pages = append(pages, ij)
+	}
+	// Pages 1 | separator, 3 4 to Invoices where the document exists already
+	pages[1].separator = &Separator{Kind: separatorQR, Destination: "Invoices", Title: "Gas"}
+	ioutil.WriteFile(filepath.Join(dir, "invoice-Gas-001.jpg"), []byte("previous"), 0644)
+	if err = bm.CombineDocuments(pages); err == nil {
+		t.Error("expecting an error for the existing document")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mail-01-001.jpg")); err != nil {
+		t.Error(err)
+	}
+	l, _ := ioutil.ReadDir(config.Quarantine)
+	if len(l) != 1 {
+		t.Fatalf("expecting the failed document only in quarantine, got %v", l)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(config.Quarantine, l[0].Name())); len(files) != 3 {
+		t.Errorf("unexpected quarantine content %v", files)
+	}
+}
@@ -0,0 +1,216 @@
+// service.go
+package main
+
+/*
+	Service mode
+
+	With -service, the program writes its PID in -pidfile, switches to -user
+	when given, and tells systemd it's ready when NOTIFY_SOCKET is set. The
+	systemd watchdog is pinged when WATCHDOG_USEC is set.
+
+	A systemd unit would look like:
+
+		[Service]
+		Type=notify
+		ExecStart=/usr/local/bin/scantopc -service -config /etc/scantopc.toml -user scanner
+		ExecReload=/bin/kill -HUP $MAINPID
+		WatchdogSec=30
+
+	"scantopc stop" sends SIGTERM to the running instance given by -pidfile.
+
+	The folder of the pid file is created when missing, and given to -user so
+	the pid file can be removed at the end.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Start service mode
+func StartService() error {
+	defer Un(Trace("StartService"))
+	if paramPIDFile != "" {
+		if pid, err := ReadPIDFile(paramPIDFile); err == nil && processAlive(pid) {
+			return NewDocumentError("StartService", fmt.Sprint("already running with PID ", pid))
+		}
+		dir := filepath.Dir(paramPIDFile)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				return NewDocumentError("StartService", "creating pid file folder", err)
+			}
+			pidFolderCreated = true
+		}
+		err := ioutil.WriteFile(paramPIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+		if err != nil {
+			return NewDocumentError("StartService", "writing pid file", err)
+		}
+	}
+	if paramUser != "" {
+		if err := SwitchUser(paramUser); err != nil {
+			return err
+		}
+	}
+	go Watchdog()
+	return nil
+}
+
+// The folder of the pid file has been created by the service
+var pidFolderCreated bool
+
+// Leave service mode
+func StopService() {
+	defer Un(Trace("StopService"))
+	if paramPIDFile != "" {
+		if err := os.Remove(paramPIDFile); err != nil {
+			WARNING.Println("StopService", err)
+		}
+	}
+}
+
+// Change process user and group. The pid file can be removed by the user
+// only when its folder belongs to the user. HOME is set to the home of the
+// user for ~ in folders.
+func SwitchUser(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return NewDocumentError("SwitchUser", name, err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if paramPIDFile != "" {
+		if err = chownPIDFile(paramPIDFile, uid, gid); err != nil {
+			return err
+		}
+	}
+	if logFile != nil {
+		logFile.Chown(uid, gid)
+	}
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return NewDocumentError("SwitchUser", "setgroups", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return NewDocumentError("SwitchUser", "setgid", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return NewDocumentError("SwitchUser", "setuid", err)
+	}
+	setUserEnv(u)
+	INFO.Println("Running as user", name)
+	return nil
+}
+
+// Environment of the user, as given by a login
+func setUserEnv(u *user.User) {
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	os.Setenv("LOGNAME", u.Username)
+}
+
+// Give the pid file to the user, and its folder when created by the service
+func chownPIDFile(filename string, uid, gid int) error {
+	dir := filepath.Dir(filename)
+	if pidFolderCreated {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return NewDocumentError("SwitchUser", "pid file folder", err)
+		}
+	} else if info, err := os.Stat(dir); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid {
+			WARNING.Println("The pid file", filename, "won't be removed at the end, folder", dir, "doesn't belong to the service user")
+		}
+	}
+	if err := os.Chown(filename, uid, gid); err != nil {
+		return NewDocumentError("SwitchUser", "pid file", err)
+	}
+	return nil
+}
+
+func ReadPIDFile(filename string) (int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, syscall.Signal(0)) == nil
+}
+
+// The "stop" command: send SIGTERM to the running instance and wait its end
+func StopCommand() int {
+	pid, err := ReadPIDFile(paramPIDFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't read pid file:", err)
+		return 1
+	}
+	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		fmt.Fprintln(os.Stderr, "Can't stop process", pid, ":", err)
+		return 1
+	}
+	fmt.Println("Stopping process", pid)
+	for end := time.Now().Add(paramStopTimeout); time.Now().Before(end); time.Sleep(200 * time.Millisecond) {
+		if !processAlive(pid) {
+			fmt.Println("Process", pid, "stopped")
+			return 0
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Process", pid, "still running after", paramStopTimeout)
+	return 1
+}
+
+// Send a state notification to systemd. Nothing is done when not launched by systemd.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Interval of watchdog pings expected by systemd, 0 when disabled
+func WatchdogInterval() time.Duration {
+	if p := os.Getenv("WATCHDOG_PID"); p != "" && p != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Ping systemd watchdog twice per interval
+func Watchdog() {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	TRACE.Println("Watchdog enabled, interval", interval)
+	ticker := time.NewTicker(interval / 2)
+	for _ = range ticker.C {
+		if _, err := SdNotify("WATCHDOG=1"); err != nil {
+			ERROR.Println("Watchdog", err)
+		}
+	}
+}
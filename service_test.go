@@ -0,0 +1,122 @@
+// service_test.go
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_SdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Error("nothing should be sent without NOTIFY_SOCKET")
+	}
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := SdNotify("READY=1"); !sent || err != nil {
+		t.Fatal("notification not sent", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("unexpected notification %q, %v", buf[:n], err)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "200000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if WatchdogInterval() != 200*time.Millisecond {
+		t.Errorf("unexpected watchdog interval %v", WatchdogInterval())
+	}
+	go Watchdog()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("unexpected notification %q, %v", buf[:n], err)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if WatchdogInterval() != 0 {
+		t.Error("watchdog is for another process")
+	}
+}
+
+func Test_PIDFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "scantopc-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	saved := paramPIDFile
+	defer func() { paramPIDFile = saved }()
+	paramPIDFile = f.Name()
+
+	if err = StartService(); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := ReadPIDFile(paramPIDFile)
+	if err != nil || pid != os.Getpid() {
+		t.Errorf("unexpected pid %d, %v", pid, err)
+	}
+	if err = StartService(); err == nil {
+		t.Error("expecting an error when already running")
+	}
+	StopService()
+	if _, err = os.Stat(paramPIDFile); !os.IsNotExist(err) {
+		t.Error("pid file not removed")
+	}
+	if !processAlive(os.Getpid()) {
+		t.Error("current process should be alive")
+	}
+}
+
+func Test_PIDFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := paramPIDFile
+	defer func() { paramPIDFile, pidFolderCreated = saved, false }()
+	paramPIDFile = filepath.Join(dir, "run", "scantopc.pid")
+
+	if err = StartService(); err != nil {
+		t.Fatal(err)
+	}
+	if !pidFolderCreated {
+		t.Error("pid file folder not created")
+	}
+	if err = chownPIDFile(paramPIDFile, os.Getuid(), os.Getgid()); err != nil {
+		t.Error(err)
+	}
+	StopService()
+	if _, err = os.Stat(paramPIDFile); !os.IsNotExist(err) {
+		t.Error("pid file not removed")
+	}
+}
+
+func Test_ParseCommand(t *testing.T) {
+	saved := paramPIDFile
+	defer func() { paramPIDFile = saved }()
+	if c := ParseCommand([]string{"stop", "-pidfile", "/tmp/scantopc-test.pid"}); c != "stop" || paramPIDFile != "/tmp/scantopc-test.pid" {
+		t.Errorf("unexpected command %q, pid file %s", c, paramPIDFile)
+	}
+}
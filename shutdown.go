@@ -0,0 +1,182 @@
+// shutdown.go
+package main
+
+/*
+	Shutdown coordination
+
+	Every document batch and page job is registered while it's in progress.
+	When the program stops, no new job is accepted, and running jobs are given
+	some time to finish:
+
+		drain = "2m"                                   # Deadline for running jobs
+		abandoned = "/var/log/scantopc-abandoned.log"   # List of unfinished jobs
+
+	Jobs still running after the deadline are listed in the abandoned file,
+	their spool folder is kept and the batch is resumed at next start. By
+	default, the list is written next to the log file.
+	When all jobs are finished, temporary folders of finished batches, kept
+	for a possible verso, are removed.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Task struct {
+	Kind    string // batch or page
+	Name    string
+	Folder  string // Temporary folder of the job
+	Started time.Time
+}
+
+type Coordinator struct {
+	sync.Mutex
+	closing bool
+	tasks   map[*Task]bool
+	held    map[string]bool // Folders of finished batches
+	done    chan bool       // Signaled when a task ends
+}
+
+var coordinator = NewCoordinator()
+
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		tasks: make(map[*Task]bool),
+		held:  make(map[string]bool),
+		done:  make(chan bool, 1),
+	}
+}
+
+// Register a new job. Refused when the program is stopping
+func (c *Coordinator) Begin(kind, name, folder string) (*Task, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closing {
+		return nil, NewDocumentError("Coordinator.Begin", "program is stopping, "+kind+" "+name+" refused")
+	}
+	t := &Task{Kind: kind, Name: name, Folder: folder, Started: time.Now()}
+	c.tasks[t] = true
+	return t, nil
+}
+
+// The job is finished
+func (c *Coordinator) End(t *Task) {
+	if t == nil {
+		return
+	}
+	c.Lock()
+	delete(c.tasks, t)
+	c.Unlock()
+	select {
+	case c.done <- true:
+	default:
+	}
+}
+
+// The folder of a finished batch is kept
+func (c *Coordinator) Hold(folder string) {
+	c.Lock()
+	c.held[folder] = true
+	c.Unlock()
+}
+
+// The folder is removed
+func (c *Coordinator) Release(folder string) {
+	c.Lock()
+	delete(c.held, folder)
+	c.Unlock()
+}
+
+// Remove folders still held
+func (c *Coordinator) CleanUp() {
+	c.Lock()
+	defer c.Unlock()
+	for folder := range c.held {
+		TRACE.Println("Coordinator.CleanUp", folder)
+		if err := os.RemoveAll(folder); err != nil {
+			ERROR.Println("Coordinator.CleanUp", err)
+		}
+		delete(c.held, folder)
+	}
+}
+
+// Running jobs, oldest first
+func (c *Coordinator) Running() []Task {
+	c.Lock()
+	defer c.Unlock()
+	l := []Task{}
+	for t := range c.tasks {
+		l = append(l, *t)
+	}
+	sort.Sort(byStart(l))
+	return l
+}
+
+type byStart []Task
+
+func (l byStart) Len() int           { return len(l) }
+func (l byStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool { return l[i].Started.Before(l[j].Started) }
+
+// Stop accepting new jobs and wait for running ones until the deadline.
+// Give jobs that are still running.
+func (c *Coordinator) Drain(deadline time.Duration) []Task {
+	defer Un(Trace("Coordinator.Drain", deadline))
+	c.Lock()
+	c.closing = true
+	c.Unlock()
+
+	timeout := time.After(deadline)
+	for {
+		l := c.Running()
+		if len(l) == 0 {
+			INFO.Println("All jobs are finished")
+			return l
+		}
+		INFO.Println("Waiting for", len(l), "running jobs,", workers.QueueDepth(), "pages queued")
+		select {
+		case <-c.done:
+		case <-timeout:
+			return c.Running()
+		}
+	}
+}
+
+// Write the list of abandoned jobs
+func WriteAbandoned(filename string, l []Task) error {
+	for _, t := range l {
+		ERROR.Println("Abandoned", t.Kind, t.Name, "started", t.Started.Format(time.RFC3339), "files in", t.Folder)
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return NewDocumentError("WriteAbandoned", filename, err)
+	}
+	defer f.Close()
+	now := time.Now().Format(time.RFC3339)
+	for _, t := range l {
+		fmt.Fprintf(f, "%s\t%s\t%s\tstarted %s\t%s\n", now, t.Kind, t.Name, t.Started.Format(time.RFC3339), t.Folder)
+	}
+	return nil
+}
+
+// Let running jobs finish before stopping the program
+func Shutdown() {
+	c := CurrentConfig()
+	l := coordinator.Drain(c.Drain.Duration)
+	if len(l) == 0 {
+		coordinator.CleanUp()
+	} else {
+		filename := c.Abandoned
+		if filename == "" {
+			filename = filepath.Join(filepath.Dir(logFile.Name()), "scantopc-abandoned.log")
+		}
+		if err := WriteAbandoned(filename, l); err != nil {
+			ERROR.Println(err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// shutdown_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Drain(t *testing.T) {
+	c := NewCoordinator()
+	fast, _ := c.Begin("page", "page-0000.jpg", "/tmp/scantopc1")
+	slow, _ := c.Begin("batch", "OCR", "/tmp/scantopc2")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.End(fast)
+	}()
+
+	l := c.Drain(300 * time.Millisecond)
+	if len(l) != 1 || l[0].Name != "OCR" {
+		t.Errorf("unexpected abandoned jobs %+v", l)
+	}
+	if _, err := c.Begin("batch", "OCR", ""); err == nil {
+		t.Error("new jobs must be refused while stopping")
+	}
+	c.End(slow)
+	if l = c.Drain(time.Second); len(l) != 0 {
+		t.Errorf("unexpected abandoned jobs %+v", l)
+	}
+}
+
+func Test_WriteAbandoned(t *testing.T) {
+	f, err := ioutil.TempFile("", "scantopc-abandoned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	err = WriteAbandoned(f.Name(), []Task{Task{Kind: "batch", Name: "OCR 2014-02-01 10:00:00", Folder: "/tmp/scantopc123", Started: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(f.Name())
+	if !strings.Contains(string(b), "batch\tOCR 2014-02-01 10:00:00") || !strings.Contains(string(b), "/tmp/scantopc123") {
+		t.Errorf("unexpected content %q", b)
+	}
+}
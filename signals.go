@@ -0,0 +1,30 @@
+// signals.go
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Signaled when the program must stop
+var terminate = make(chan os.Signal, 1)
+
+// SIGTERM and SIGINT stop the program,
+// SIGHUP reloads the configuration file. A configuration with errors is
+// rejected, and the running one is kept.
+func HandleSignals() {
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			INFO.Println("SIGHUP received, reloading configuration", paramConfigFile)
+			if _, err := ReloadConfig(); err != nil {
+				ERROR.Println("New configuration rejected, keeping the running one:", err)
+				continue
+			}
+			INFO.Println("Configuration reloaded")
+		}
+	}()
+}
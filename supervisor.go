@@ -0,0 +1,220 @@
+// supervisor.go
+package main
+
+/*
+	Connection supervisor
+
+	Keeps the health state of each served device, and computes the delay
+	before the next connection attempt. The delay doubles at each failure, up
+	to a limit:
+
+		retrymin = "5s"
+		retrymax = "10m"
+
+	A device that doesn't answer to scan requests but is still present on the
+	network is considered as sleeping, otherwise it's unreachable. A device is
+	connected again once its session has lasted one minute, a session failing
+	at once counts as a failure.
+*/
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DeviceState int
+
+const (
+	DeviceConnecting DeviceState = iota
+	DeviceConnected
+	DeviceSleeping
+	DeviceUnreachable
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceConnecting:
+		return "connecting"
+	case DeviceConnected:
+		return "connected"
+	case DeviceSleeping:
+		return "sleeping"
+	case DeviceUnreachable:
+		return "unreachable"
+	}
+	return "unknown"
+}
+
+// Health of a device
+type DeviceStatus struct {
+	URL         string // URL given by the configuration, empty when discovered
+	LastGoodURL string // URL of the last successful connection
+	State       DeviceState
+	Since       time.Time // Time of last state change
+	Failures    int       // Consecutive connection failures
+	LastError   error
+	Session     time.Time // Start of the current session
+}
+
+// Duration of a session before the device is considered as connected again
+const stableSession = time.Minute
+
+type Supervisor struct {
+	sync.Mutex
+	devices map[string]*DeviceStatus
+}
+
+var supervisor = NewSupervisor()
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{devices: make(map[string]*DeviceStatus)}
+}
+
+// Give the status of the device, the status is created when needed
+func (s *Supervisor) status(url string) *DeviceStatus {
+	d, ok := s.devices[url]
+	if !ok {
+		d = &DeviceStatus{URL: url, State: DeviceConnecting, Since: time.Now()}
+		s.devices[url] = d
+	}
+	if d.State != DeviceConnected && !d.Session.IsZero() && time.Since(d.Session) >= stableSession {
+		d.Failures = 0
+		d.LastError = nil
+		s.setState(d, DeviceConnected)
+	}
+	return d
+}
+
+func (s *Supervisor) setState(d *DeviceStatus, state DeviceState) {
+	if d.State != state {
+		INFO.Println("Device", d.name(), "is now", state)
+		d.State = state
+		d.Since = time.Now()
+	}
+}
+
+func (d *DeviceStatus) name() string {
+	if d.URL == "" {
+		if d.LastGoodURL == "" {
+			return "(discovery)"
+		}
+		return d.LastGoodURL
+	}
+	return d.URL
+}
+
+// URL to be used for next connection attempt. Empty when the device must be
+// searched on the network
+func (s *Supervisor) NextURL(url string) string {
+	s.Lock()
+	defer s.Unlock()
+	if url != "" {
+		return url
+	}
+	return s.status(url).LastGoodURL
+}
+
+// Record a successful connection. After failures, the device is connected
+// once the session has lasted long enough.
+func (s *Supervisor) Connected(url, deviceURL string) {
+	s.Lock()
+	defer s.Unlock()
+	d := s.status(url)
+	d.LastGoodURL = deviceURL
+	d.Session = time.Now()
+	if d.Failures == 0 {
+		s.setState(d, DeviceConnected)
+	}
+}
+
+// Record a failure and give the delay before next attempt
+func (s *Supervisor) Failed(url string, err error) time.Duration {
+	c := CurrentConfig()
+	known := s.NextURL(url)
+	reachable := known != "" && Reachable(known)
+
+	s.Lock()
+	defer s.Unlock()
+	d := s.status(url)
+	if d.State == DeviceConnected || d.LastError == nil || d.LastError.Error() != err.Error() {
+		ERROR.Println("Device", d.name(), err)
+	} else {
+		TRACE.Println("Device", d.name(), err)
+	}
+	d.Failures++
+	d.LastError = err
+	d.Session = time.Time{}
+	if reachable {
+		s.setState(d, DeviceSleeping)
+	} else {
+		s.setState(d, DeviceUnreachable)
+	}
+	delay := Backoff(d.Failures, c.RetryMin.Duration, c.RetryMax.Duration)
+	TRACE.Println("Device", d.name(), "next attempt in", delay)
+	return delay
+}
+
+// Remove the status of a device no longer served
+func (s *Supervisor) Forget(url string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.devices, url)
+}
+
+// Status of all devices, sorted by URL
+func (s *Supervisor) Status() []DeviceStatus {
+	s.Lock()
+	defer s.Unlock()
+	l := []DeviceStatus{}
+	for url := range s.devices {
+		l = append(l, *s.status(url))
+	}
+	sort.Sort(byURL(l))
+	return l
+}
+
+// State of the device
+func (s *Supervisor) State(url string) DeviceState {
+	s.Lock()
+	defer s.Unlock()
+	return s.status(url).State
+}
+
+type byURL []DeviceStatus
+
+func (l byURL) Len() int           { return len(l) }
+func (l byURL) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byURL) Less(i, j int) bool { return l[i].URL < l[j].URL }
+
+// Delay before next attempt after n consecutive failures
+func Backoff(n int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Check if the device still answers on the network
+func Reachable(deviceURL string) bool {
+	u, err := url.Parse(deviceURL)
+	if err != nil {
+		return false
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,76 @@
+// supervisor_test.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_Backoff(t *testing.T) {
+	min, max := 5*time.Second, time.Minute
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, e := range expected {
+		if d := Backoff(i+1, min, max); d != e {
+			t.Errorf("failure %d: expecting %v, got %v", i+1, e, d)
+		}
+	}
+}
+
+func Test_SupervisorStates(t *testing.T) {
+	c := &Config{}
+	c.MergeFlags(map[string]bool{})
+	SetCurrentConfig(c)
+
+	printer := httptest.NewServer(http.NotFoundHandler())
+	s := NewSupervisor()
+
+	if s.NextURL("") != "" {
+		t.Error("expecting discovery before first connection")
+	}
+	s.Connected("", printer.URL)
+	if s.State("") != DeviceConnected || s.NextURL("") != printer.URL {
+		t.Errorf("unexpected status %+v", s.Status())
+	}
+
+	// Printer still present on the network
+	if d := s.Failed("", errors.New("lost")); d != c.RetryMin.Duration {
+		t.Errorf("unexpected delay %v", d)
+	}
+	if s.State("") != DeviceSleeping {
+		t.Errorf("expecting sleeping device, got %v", s.State(""))
+	}
+
+	// Printer gone
+	printer.Close()
+	if d := s.Failed("", errors.New("lost")); d != 2*c.RetryMin.Duration {
+		t.Errorf("unexpected delay %v", d)
+	}
+	if s.State("") != DeviceUnreachable {
+		t.Errorf("expecting unreachable device, got %v", s.State(""))
+	}
+	if s.NextURL("") != printer.URL {
+		t.Error("last good URL is lost")
+	}
+
+	// Session failing at once
+	s.Connected("", printer.URL)
+	if l := s.Status(); len(l) != 1 || l[0].Failures != 2 || l[0].State != DeviceUnreachable {
+		t.Errorf("unexpected status %+v", l)
+	}
+	if d := s.Failed("", errors.New("lost")); d != 4*c.RetryMin.Duration {
+		t.Errorf("unexpected delay %v", d)
+	}
+
+	// Session lasting
+	s.Connected("", printer.URL)
+	s.devices[""].Session = time.Now().Add(-stableSession)
+	if l := s.Status(); len(l) != 1 || l[0].Failures != 0 || l[0].State != DeviceConnected {
+		t.Errorf("unexpected status %+v", l)
+	}
+	if d := s.Failed("", errors.New("lost")); d != c.RetryMin.Duration {
+		t.Errorf("unexpected delay %v", d)
+	}
+}
@@ -0,0 +1,138 @@
+// verso.go
+package main
+
+/*
+	Verso merging
+
+	Double sided documents are scanned with a single side ADF in two batches:
+	the recto pages, then the pile is flipped and scanned with a destination
+	having verso = true. Verso pages come in the reverse order.
+
+		[[destination]]
+		name = "OCR (Verso)"
+		verso = true
+		versogap = "15m"          # Maximum time between the recto and the verso
+		versotolerance = 1        # Accepted difference of page counts
+		versopolicy = "pad"       # When counts differ: pad, match or separate
+
+	When page counts differ, within the tolerance, the policy gives what to do:
+		pad       missing pages are replaced by blank pages
+		match     pages having their opposite are merged, others are added at the end
+		separate  the verso is written as its own document
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Policies when recto and verso page counts differ
+const (
+	versoPad      = "pad"
+	versoMatch    = "match"
+	versoSeparate = "separate"
+)
+
+// Decide how verso pages are merged with recto pages. Give the page order,
+// where nil entries are blank pages, or nil when the verso is kept
+// separate, and the reason of the decision.
+func VersoMerge(recto, verso []*imageJob, d *Destination, gap time.Duration) ([]*imageJob, string) {
+	if gap > d.VersoGap.Duration {
+		return nil, fmt.Sprint("recto is too old (", gap/time.Second*time.Second, ", maximum ", d.VersoGap.Duration, ")")
+	}
+	n, m := len(recto), len(verso)
+	diff := n - m
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > *d.VersoTolerance {
+		return nil, fmt.Sprint("page counts differ too much (", n, " recto, ", m, " verso)")
+	}
+	if diff > 0 && d.VersoPolicy == versoSeparate {
+		return nil, fmt.Sprint("page counts differ (", n, " recto, ", m, " verso), policy is ", versoSeparate)
+	}
+
+	// Verso pages in the recto order
+	reversed := make([]*imageJob, m)
+	for i := range verso {
+		reversed[i] = verso[m-i-1]
+	}
+	pages := []*imageJob{}
+	for i := 0; i < n || i < m; i++ {
+		switch {
+		case i < n && i < m:
+			pages = append(pages, recto[i], reversed[i])
+		case i < n:
+			pages = append(pages, recto[i])
+			if d.VersoPolicy == versoPad {
+				pages = append(pages, nil)
+			}
+		default:
+			if d.VersoPolicy == versoPad {
+				pages = append(pages, nil)
+			}
+			pages = append(pages, reversed[i])
+		}
+	}
+	if diff == 0 {
+		return pages, fmt.Sprint("same page count (", n, ")")
+	}
+	return pages, fmt.Sprint("page counts differ (", n, " recto, ", m, " verso), policy is ", d.VersoPolicy)
+}
+
+// Replace nil entries by blank pages having the size of their opposite page
+func (bm *OCRBatchImageManager) BlankPages(pages []*imageJob) error {
+	for i, ij := range pages {
+		if ij != nil {
+			continue
+		}
+		opposite := pages[i^1]
+		blank, err := bm.NewBlankPage(fmt.Sprintf("blank-%04d.jpg", i), opposite)
+		if err != nil {
+			return err
+		}
+		pages[i] = blank
+	}
+	return nil
+}
+
+// Create a white page of the size of another one
+func (bm *OCRBatchImageManager) NewBlankPage(name string, like *imageJob) (*imageJob, error) {
+	f, err := os.Open(like.current)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, NewDocumentError("NewBlankPage", like.current, err)
+	}
+	ij := &imageJob{
+		filename:    filepath.Join(bm.tempfolder, name),
+		destination: bm.destination,
+		format:      bm.format,
+	}
+	ij.current = ij.filename
+	img := image.NewGray(image.Rect(0, 0, cfg.Width, cfg.Height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	if f, err = os.Create(ij.filename); err != nil {
+		return nil, err
+	}
+	err = jpeg.Encode(f, img, nil)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && bm.format == ".pdf" {
+		err = WriteSearchablePDF(ij.filename, "", like.destination.Resolution, ij.PDFName())
+	}
+	if err != nil {
+		return nil, NewDocumentError("NewBlankPage", ij.filename, err)
+	}
+	return ij, nil
+}
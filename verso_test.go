@@ -0,0 +1,91 @@
+// verso_test.go
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPages(prefix string, n int) []*imageJob {
+	l := []*imageJob{}
+	for i := 0; i < n; i++ {
+		l = append(l, &imageJob{filename: JPEGPageName(prefix, i)})
+	}
+	return l
+}
+
+func pageNames(pages []*imageJob) string {
+	names := []string{}
+	for _, p := range pages {
+		if p == nil {
+			names = append(names, "blank")
+		} else {
+			names = append(names, p.filename)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func Test_VersoMerge(t *testing.T) {
+	for _, c := range []struct {
+		recto, verso int
+		policy       string
+		gap          time.Duration
+		expected     string // empty when kept separate
+	}{
+		{2, 2, versoSeparate, time.Minute, "r-001,v-002,r-002,v-001"},
+		{2, 2, versoPad, time.Hour, ""},
+		{3, 2, versoSeparate, time.Minute, ""},
+		{3, 2, versoPad, time.Minute, "r-001,v-002,r-002,v-001,r-003,blank"},
+		{3, 2, versoMatch, time.Minute, "r-001,v-002,r-002,v-001,r-003"},
+		{2, 3, versoPad, time.Minute, "r-001,v-003,r-002,v-002,blank,v-001"},
+		{2, 3, versoMatch, time.Minute, "r-001,v-003,r-002,v-002,v-001"},
+		{4, 2, versoPad, time.Minute, ""},
+	} {
+		tolerance := 1
+		d := &Destination{VersoGap: &duration{15 * time.Minute}, VersoTolerance: &tolerance, VersoPolicy: c.policy}
+		pages, reason := VersoMerge(testPages("r", c.recto), testPages("v", c.verso), d, c.gap)
+		if reason == "" {
+			t.Errorf("%+v: no reason given", c)
+		}
+		if c.expected == "" {
+			if pages != nil {
+				t.Errorf("%+v: expecting separate documents, got %s", c, pageNames(pages))
+			}
+			continue
+		}
+		if got := pageNames(pages); got != c.expected {
+			t.Errorf("%+v: expecting %s, got %s (%s)", c, c.expected, got, reason)
+		}
+	}
+}
+
+func Test_BlankPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scantopc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &Destination{Resolution: 72}
+	bm := &OCRBatchImageManager{tempfolder: dir, destination: d, format: ".pdf"}
+	recto := &imageJob{filename: filepath.Join(dir, "page-0000.jpg"), destination: d}
+	recto.current = recto.filename
+	writeTestJPEG(t, recto.filename, 40, 60)
+
+	pages := []*imageJob{recto, nil}
+	if err := bm.BlankPages(pages); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadPDFFile(pages[1].PDFName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := r.Pages()
+	if box := r.array(r.Page(p[0])["MediaBox"]); len(box) != 4 || box[2] != 40 || box[3] != 60 {
+		t.Errorf("blank page should have the recto size, got %v", box)
+	}
+}
@@ -0,0 +1,164 @@
+// workers.go
+package main
+
+/*
+	Page processing workers
+
+	Pages are processed by a shared pool of workers, which limits the number
+	of convert and tesseract processes running together:
+
+		workers = 2     # Default is the number of CPUs
+
+	Pages waiting for a worker are queued. Pages of earlier batches are taken
+	first, then pages in their reception order, so documents are finished in
+	their scan order.
+*/
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+type WorkerStatus struct {
+	ID    int
+	Busy  bool
+	Page  string // Page being processed
+	Step  string // Step in progress
+	Since time.Time
+	stop  bool // Removed by a resize, stops when idle
+}
+
+type queuedPage struct {
+	ij  *imageJob
+	seq int
+}
+
+type WorkerPool struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queue   []queuedPage
+	seq     int
+	size    int // Wanted number of workers
+	nextID  int
+	workers []*WorkerStatus
+}
+
+var workers = NewWorkerPool()
+
+func NewWorkerPool() *WorkerPool {
+	p := &WorkerPool{}
+	p.cond = sync.NewCond(p)
+	return p
+}
+
+// Queue a page for processing. The number of workers follows the
+// configuration.
+func (p *WorkerPool) Submit(ij *imageJob) {
+	n := runtime.NumCPU()
+	if c := CurrentConfig(); c != nil && c.Workers > 0 {
+		n = c.Workers
+	}
+	p.submit(ij, n)
+}
+
+func (p *WorkerPool) submit(ij *imageJob, n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.resize(n)
+	p.seq++
+	q := queuedPage{ij, p.seq}
+	i := sort.Search(len(p.queue), func(i int) bool { return q.before(p.queue[i]) })
+	p.queue = append(p.queue, queuedPage{})
+	copy(p.queue[i+1:], p.queue[i:])
+	p.queue[i] = q
+	TRACE.Println("Page", ij.filename, "queued,", len(p.queue), "pages waiting")
+	p.cond.Signal()
+}
+
+func (q queuedPage) before(o queuedPage) bool {
+	if !q.ij.batch.Equal(o.ij.batch) {
+		return q.ij.batch.Before(o.ij.batch)
+	}
+	return q.seq < o.seq
+}
+
+// Start or stop workers to have n of them
+func (p *WorkerPool) resize(n int) {
+	if n == p.size {
+		return
+	}
+	TRACE.Println("WorkerPool.resize", p.size, "->", n)
+	for ; p.size < n; p.size++ {
+		w := &WorkerStatus{ID: p.nextID, Since: time.Now()}
+		p.nextID++
+		p.workers = append(p.workers, w)
+		go p.work(w)
+	}
+	for i := len(p.workers) - 1; i >= 0 && p.size > n; i-- {
+		if !p.workers[i].stop {
+			p.workers[i].stop = true
+			p.size--
+		}
+	}
+	// Extra workers stop when they are idle
+	p.cond.Broadcast()
+}
+
+func (p *WorkerPool) work(w *WorkerStatus) {
+	p.Lock()
+	for {
+		for len(p.queue) == 0 && !w.stop {
+			p.cond.Wait()
+		}
+		if w.stop {
+			break
+		}
+		ij := p.queue[0].ij
+		p.queue = p.queue[1:]
+		w.Busy, w.Page, w.Step, w.Since = true, ij.filename, "", time.Now()
+		ij.worker = w
+		p.Unlock()
+
+		ij.ImageProcessing()
+
+		p.Lock()
+		w.Busy, w.Page, w.Step, w.Since = false, "", "", time.Now()
+	}
+	for i := range p.workers {
+		if p.workers[i] == w {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			break
+		}
+	}
+	p.Unlock()
+}
+
+// Record the step in progress of a worker
+func (p *WorkerPool) SetStep(w *WorkerStatus, step string) {
+	if w == nil {
+		return
+	}
+	p.Lock()
+	w.Step = step
+	p.Unlock()
+}
+
+// Number of pages waiting for a worker
+func (p *WorkerPool) QueueDepth() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.queue)
+}
+
+// State of each worker
+func (p *WorkerPool) Status() []WorkerStatus {
+	p.Lock()
+	defer p.Unlock()
+	l := make([]WorkerStatus, len(p.workers))
+	for i, w := range p.workers {
+		l[i] = *w
+	}
+	return l
+}
@@ -0,0 +1,82 @@
+// workers_test.go
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_WorkerPool(t *testing.T) {
+	p := NewWorkerPool()
+	done := make(chan *imageJob, 10)
+	early := time.Now().Add(-time.Minute)
+	late := time.Now()
+	for _, c := range []struct {
+		name  string
+		batch time.Time
+	}{
+		{"late-0", late},
+		{"early-0", early},
+		{"late-1", late},
+		{"early-1", early},
+	} {
+		ij := &imageJob{filename: c.name, batch: c.batch, destination: &Destination{}, endChan: done}
+		// No worker yet, pages are queued
+		p.submit(ij, 0)
+	}
+	if p.QueueDepth() != 4 || len(p.Status()) != 0 {
+		t.Fatalf("expecting 4 queued pages and no worker, got %d %v", p.QueueDepth(), p.Status())
+	}
+
+	p.Lock()
+	p.resize(1)
+	p.Unlock()
+	for _, expected := range []string{"early-0", "early-1", "late-0", "late-1"} {
+		select {
+		case ij := <-done:
+			if ij.filename != expected {
+				t.Errorf("expecting %s, got %s", expected, ij.filename)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("page not processed")
+		}
+	}
+	if s := p.Status(); len(s) != 1 || s[0].ID != 0 {
+		t.Errorf("unexpected workers %v", s)
+	}
+
+	p.Lock()
+	p.resize(3)
+	p.resize(1)
+	p.Unlock()
+	for end := time.Now().Add(5 * time.Second); len(p.Status()) != 1 && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := p.Status(); len(s) != 1 || s[0].ID != 0 || s[0].Busy {
+		t.Errorf("unexpected workers after resize %v", s)
+	}
+}
+
+func Test_WorkerPoolBatchNotClosed(t *testing.T) {
+	p := NewWorkerPool()
+	// Nothing reads pages of the batch until it's closed
+	batch := make(chan *imageJob)
+	for i := 0; i < 3; i++ {
+		p.submit(&imageJob{filename: fmt.Sprint("adf-", i), destination: &Destination{}, endChan: batch}, 1)
+	}
+	other := make(chan *imageJob, 1)
+	p.submit(&imageJob{filename: "other", batch: time.Now(), destination: &Destination{}, endChan: other}, 1)
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker blocked by a batch not yet closed")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-batch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("page of the batch lost")
+		}
+	}
+}